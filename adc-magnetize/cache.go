@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A hashCache remembers the hashes of files between runs, so
+// that only new or modified files need be read again.
+type hashCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]*cacheEntry // by absolute path
+	changed bool
+}
+
+// cacheEntry is the hash of a file as it was when hashed,
+// it is stale once the size, modification time or inode differ.
+type cacheEntry struct {
+	Size      int64
+	ModTime   int64
+	Inode     uint64
+	TTH       []byte
+	SHA1      []byte // nil unless hashed for -format bitprint
+	BlockSize int64  // of the leaves, zero if none were kept
+	Leaves    [][]byte
+}
+
+// loadCache reads the cache at path, a missing file is an empty cache.
+func loadCache(path string) (*hashCache, error) {
+	c := &hashCache{path: path, entries: make(map[string]*cacheEntry)}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	if err = gob.NewDecoder(file).Decode(&c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func cacheKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// get returns the entry for a file if it is still current and
+// holds everything this run needs, or nil.
+func (c *hashCache) get(path string, info os.FileInfo, sha1, leaves bool, blockSize int64) *cacheEntry {
+	if c == nil || *rehash {
+		return nil
+	}
+	c.mu.Lock()
+	e := c.entries[cacheKey(path)]
+	c.mu.Unlock()
+	switch {
+	case e == nil:
+	case e.Size != info.Size() || e.ModTime != info.ModTime().UnixNano() || e.Inode != inode(info):
+	case sha1 && e.SHA1 == nil:
+	case leaves && (e.BlockSize != blockSize || e.Leaves == nil):
+	default:
+		return e
+	}
+	return nil
+}
+
+func (c *hashCache) put(path string, e *cacheEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.entries[cacheKey(path)] = e
+	c.changed = true
+	c.mu.Unlock()
+}
+
+// save writes the cache back if anything was added, leaving
+// out the files that no longer exist.
+func (c *hashCache) save() error {
+	if c == nil || !c.changed {
+		return nil
+	}
+	for path := range c.entries {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(c.entries, path)
+		}
+	}
+	tmp := c.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(file).Encode(c.entries)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/3M3RY/go-adc/adc"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// checkEntry is a magnet from a list and the file it names.
+type checkEntry struct {
+	magnet *adc.Magnet
+	path   string
+	job    *hashJob // nil if there is nothing to hash
+	result string   // set if known without hashing
+}
+
+// check hashes the files named by each magnet link in list, looking
+// for them in dir, and reports each as OK, FAILED or MISSING in the
+// manner of sha256sum -c. It returns false if any did not pass.
+func check(list, dir string) bool {
+	file, err := os.Open(list)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening", list+":", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	var entries []*checkEntry
+	var jobs []*hashJob
+	bad := 0
+	s := bufio.NewScanner(file)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		m, err := adc.ParseMagnet(line)
+		if err == nil && (m.TTH == nil || m.DisplayName == "") {
+			err = adc.Error("no dn or tiger tree hash")
+		}
+		if err == nil && !localName(m.DisplayName) {
+			err = fmt.Errorf("dn %q is not a path beneath the directory", m.DisplayName)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", list, n, err)
+			bad++
+			continue
+		}
+
+		e := &checkEntry{magnet: m, path: filepath.Join(dir, filepath.FromSlash(m.DisplayName))}
+		info, err := os.Stat(e.path)
+		switch {
+		case err != nil || info.IsDir():
+			e.result = "MISSING"
+		case m.Size != 0 && uint64(info.Size()) != m.Size:
+			e.result = "FAILED"
+		default:
+			e.job = newHashJob(e.path, m.DisplayName, info)
+			jobs = append(jobs, e.job)
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading", list+":", err)
+		os.Exit(1)
+	}
+	if bad > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %d lines are improperly formatted\n", bad)
+	}
+
+	var failed, missing int
+	results := hashFiles(jobs, *workers)
+	for _, e := range entries {
+		if e.job != nil {
+			j := <-results
+			switch {
+			case j.err != nil:
+				fmt.Fprintln(os.Stderr, "Error hashing", j.path+",", j.err)
+				e.result = "FAILED"
+			case bytes.Equal(j.tth.Bytes(), e.magnet.TTH.Bytes()):
+				e.result = "OK"
+			default:
+				e.result = "FAILED"
+			}
+		}
+		switch e.result {
+		case "FAILED":
+			failed++
+		case "MISSING":
+			missing++
+		}
+		fmt.Printf("%s: %s\n", e.path, e.result)
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %d computed hashes did NOT match\n", failed)
+	}
+	if missing > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %d listed files could not be found\n", missing)
+	}
+	return bad == 0 && failed == 0 && missing == 0
+}
+
+// localName reports whether a dn names a file beneath the
+// directory being checked, rather than an absolute path or
+// one that climbs out of it with "..".
+func localName(name string) bool {
+	if path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" ||
+		strings.Contains(name, "\\") {
+		return false
+	}
+	for _, e := range strings.Split(name, "/") {
+		if e == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/3M3RY/go-adc/adc"
+	"io"
+	"strings"
+)
+
+// A formatter writes out each hashed file in turn.
+type formatter interface {
+	add(j *hashJob) error
+	// close writes anything held back until the end.
+	close() error
+}
+
+func newFormatter(name string, w io.Writer) (formatter, error) {
+	switch name {
+	case "magnet":
+		return &magnetFormatter{w: w}, nil
+	case "bitprint":
+		return &magnetFormatter{w: w, bitprint: true}, nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return &jsonFormatter{enc}, nil
+	case "text":
+		return &textFormatter{w}, nil
+	case "xml":
+		return &xmlFormatter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", name)
+}
+
+// magnetFor returns the magnet link of a hashed file, named in dn
+// by its path beneath the directory it was found in with -r, so
+// that -check may find it again from the same directory.
+func magnetFor(j *hashJob) *adc.Magnet {
+	name := j.info.Name()
+	if i := strings.Index(j.listPath, "/"); i >= 0 {
+		name = j.listPath[i+1:]
+	}
+	m := &adc.Magnet{
+		TTH:         j.tth,
+		DisplayName: name,
+		Size:        uint64(j.info.Size()),
+	}
+	if *exactSource != "" {
+		m.ExactSources = []string{*exactSource}
+	}
+	return m
+}
+
+// magnetFormatter writes a magnet link per line, with a
+// urn:bitprint of the SHA1 and TTH if bitprint is set.
+type magnetFormatter struct {
+	w        io.Writer
+	bitprint bool
+}
+
+func (f *magnetFormatter) add(j *hashJob) error {
+	m := magnetFor(j)
+	if f.bitprint {
+		m.SHA1 = j.sha1
+	}
+	_, err := fmt.Fprintln(f.w, m)
+	return err
+}
+
+func (f *magnetFormatter) close() error { return nil }
+
+// jsonFormatter writes a JSON object per line.
+type jsonFormatter struct {
+	enc *json.Encoder
+}
+
+func (f *jsonFormatter) add(j *hashJob) error {
+	return f.enc.Encode(struct {
+		Path   string `json:"path"`
+		Size   int64  `json:"size"`
+		TTH    string `json:"tth"`
+		Magnet string `json:"magnet"`
+	}{j.path, j.info.Size(), j.tth.String(), magnetFor(j).String()})
+}
+
+func (f *jsonFormatter) close() error { return nil }
+
+// textFormatter writes the hash and path of each file
+// separated by two spaces, as sha256sum does.
+type textFormatter struct {
+	w io.Writer
+}
+
+func (f *textFormatter) add(j *hashJob) error {
+	_, err := fmt.Fprintf(f.w, "%s  %s\n", j.tth, j.path)
+	return err
+}
+
+func (f *textFormatter) close() error { return nil }
+
+// xmlFormatter gathers the files into an ADC file list,
+// with directories as they were found beneath the arguments.
+type xmlFormatter struct {
+	w    io.Writer
+	root adc.FileListDir
+}
+
+func (f *xmlFormatter) add(j *hashJob) error {
+	d := &f.root
+	names := strings.Split(j.listPath, "/")
+	for _, name := range names[:len(names)-1] {
+		sub := d.Dir(name)
+		if sub == nil {
+			sub = &adc.FileListDir{Name: name}
+			d.Dirs = append(d.Dirs, sub)
+		}
+		d = sub
+	}
+	d.Files = append(d.Files, &adc.FileListFile{
+		Name: names[len(names)-1],
+		Size: uint64(j.info.Size()),
+		TTH:  j.tth.String(),
+		TS:   j.info.ModTime().Unix(),
+	})
+	return nil
+}
+
+func (f *xmlFormatter) close() error {
+	l := &adc.FileList{
+		Version:     "1",
+		Base:        "/",
+		Generator:   adc.Generator,
+		FileListDir: f.root,
+	}
+	if _, err := io.WriteString(f.w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(f.w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(l); err != nil {
+		return err
+	}
+	_, err := io.WriteString(f.w, "\n")
+	return err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/3M3RY/go-adc/adc"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// the size of each read from a file being hashed
+const readSize = 1 << 20
+
+// A hashJob is a file to hash and, once done is closed, its hash.
+type hashJob struct {
+	path     string
+	listPath string // the path beneath the argument it was found by, separated by '/'
+	info     os.FileInfo
+	tth      *adc.TigerTreeHash
+	sha1     []byte // only for -format bitprint
+	err      error
+	done     chan bool
+}
+
+func newHashJob(path, listPath string, info os.FileInfo) *hashJob {
+	return &hashJob{path: path, listPath: listPath, info: info, done: make(chan bool)}
+}
+
+func (j *hashJob) hash(buf []byte) {
+	defer close(j.done)
+	bitprint := *format == "bitprint"
+	size := int64(1 << 30)
+	if wantLeaves() {
+		size = leafBlockSize(j.info.Size())
+	}
+	if e := cache.get(j.path, j.info, bitprint, wantLeaves(), size); e != nil {
+		j.tth = adc.NewTigerTreeHashFromBytes(e.TTH)
+		j.sha1 = e.SHA1
+		if wantLeaves() {
+			j.err = writeLeaves(j, e.Leaves)
+		}
+		return
+	}
+
+	file, err := os.Open(j.path)
+	if err != nil {
+		j.err = err
+		return
+	}
+	defer file.Close()
+
+	// everything is hashed in the one pass over the file
+	tree := adc.NewTreeHasher(size)
+	var w io.Writer = tree
+	var sha hash.Hash
+	if bitprint {
+		sha = sha1.New()
+		w = io.MultiWriter(tree, sha)
+	}
+	if _, err = io.CopyBuffer(w, file, buf); err != nil {
+		j.err = err
+		return
+	}
+	j.tth = adc.NewTigerTreeHashFromBytes(tree.Root())
+	if sha != nil {
+		j.sha1 = sha.Sum(nil)
+	}
+
+	e := &cacheEntry{
+		Size:    j.info.Size(),
+		ModTime: j.info.ModTime().UnixNano(),
+		Inode:   inode(j.info),
+		TTH:     tree.Root(),
+		SHA1:    j.sha1,
+	}
+	if wantLeaves() {
+		e.BlockSize = size
+		e.Leaves = tree.Leaves()
+		if j.err = writeLeaves(j, e.Leaves); j.err != nil {
+			return
+		}
+	}
+	cache.put(j.path, e)
+}
+
+// hashFiles hashes the jobs with the given number of workers,
+// returning them in their original order as each is done.
+func hashFiles(jobs []*hashJob, workers int) <-chan *hashJob {
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan *hashJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, readSize)
+			for j := range queue {
+				j.hash(buf)
+			}
+		}()
+	}
+	go func() {
+		for _, j := range jobs {
+			queue <- j
+		}
+		close(queue)
+	}()
+
+	out := make(chan *hashJob)
+	go func() {
+		for _, j := range jobs {
+			<-j.done
+			out <- j
+		}
+		close(out)
+	}()
+	return out
+}
+
+// patternList collects repeated glob flags.
+type patternList []string
+
+func (l *patternList) String() string { return strings.Join(*l, ",") }
+
+func (l *patternList) Set(s string) error {
+	if _, err := filepath.Match(s, ""); err != nil {
+		return err
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+// match reports whether any pattern matches the name or the path of a file.
+func (l patternList) match(path string) bool {
+	name := filepath.Base(path)
+	for _, p := range l {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, filepath.ToSlash(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collect turns the arguments into jobs, walking directories
+// with -r and passing over the files excluded by the globs.
+func collect(args []string) (jobs []*hashJob) {
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening", arg+":", err)
+			os.Exit(1)
+		}
+		if !info.IsDir() {
+			if info.Size() == 0 {
+				fmt.Fprintln(os.Stderr, "Skipping empty file", arg)
+				continue
+			}
+			jobs = append(jobs, newHashJob(arg, info.Name(), info))
+			continue
+		}
+		if !*recursive {
+			fmt.Fprintln(os.Stderr, "Skipping directory", arg)
+			continue
+		}
+		top := arg
+		if abs, err := filepath.Abs(arg); err == nil {
+			top = abs
+		}
+		top = filepath.Base(top)
+		filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error walking", path+":", err)
+				return nil
+			}
+			if !info.Mode().IsRegular() || info.Size() == 0 {
+				return nil
+			}
+			// leaf data written by an earlier run is not itself hashed
+			if *tthl && strings.HasSuffix(path, tthlSuffix) {
+				return nil
+			}
+			if len(includes) > 0 && !includes.match(path) {
+				return nil
+			}
+			if excludes.match(path) {
+				return nil
+			}
+			rel, err := filepath.Rel(arg, path)
+			if err != nil {
+				return nil
+			}
+			jobs = append(jobs, newHashJob(path, top+"/"+filepath.ToSlash(rel), info))
+			return nil
+		})
+	}
+	return jobs
+}
@@ -1,78 +1,83 @@
 package main
 
 import (
-	"encoding/base32"
 	"flag"
 	"fmt"
-	"github.com/3M3RY/go-thex"
-	"github.com/3M3RY/go-tiger"
-	"io"
-	"net/url"
 	"os"
+	"runtime"
 )
 
 var (
 	exactSource = flag.String("xs", "", "eXact Source link to a file (adc://example.com:1511)")
+	recursive   = flag.Bool("r", false, "hash every file beneath directories")
+	workers     = flag.Int("j", runtime.NumCPU(), "how many files to hash at once")
+	format      = flag.String("format", "magnet", "output format: magnet, bitprint, json, text or xml")
+	tthl        = flag.Bool("tthl", false, "write the leaves of the hash tree beside each file, with the suffix .tthl")
+	tthlDir     = flag.String("tthl-dir", "", "write the leaves of the hash tree into a directory, named by the TTH of each file")
+	blockSize   = flag.Int64("block-size", 0, "the bytes covered by each leaf written, 1024 multiplied by a power of two, by default enough for at most 512 leaves")
+	cachePath   = flag.String("cache", "", "a file to keep hashes in, so that files unchanged since the last run are not read again")
+	rehash      = flag.Bool("rehash", false, "with -cache, hash every file again rather than trusting the cache")
+	checkList   = flag.String("check", "", "check the files named by the magnet links in a file, found in the directory given or the current one")
+	includes    patternList
+	excludes    patternList
+	cache       *hashCache // nil without -cache
 )
 
+func init() {
+	flag.Var(&includes, "include", "with -r, only hash files whose name or path matches a glob, may be given more than once")
+	flag.Var(&excludes, "exclude", "with -r, skip files whose name or path matches a glob, may be given more than once")
+}
+
 func main() {
 	flag.Parse()
+	if *checkList != "" {
+		dir := "."
+		if flag.NArg() > 0 {
+			dir = flag.Arg(0)
+		}
+		if !check(*checkList, dir) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if len(flag.Args()) == 0 {
 		fmt.Println("file not specified")
 		os.Exit(1)
 	}
 
-	for _, arg := range flag.Args() {
-
-		file, err := os.OpenFile(arg, os.O_RDONLY, 0)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error opening", arg+":", err)
+	checkBlockSize()
+	if *cachePath != "" {
+		var err error
+		if cache, err = loadCache(*cachePath); err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading cache", *cachePath+":", err)
 			os.Exit(1)
 		}
-		info, err := file.Stat()
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error getting file stats:", err)
-			os.Exit(1)
-		}
-
-		if info.IsDir() {
-			fmt.Fprintln(os.Stderr, "Skipping directory", arg)
-			continue
-		}
-		if info.Size() == 0 {
-			fmt.Fprintln(os.Stderr, "Skipping empty file", arg)
-			continue
-		}
-
-		tree := thex.New(tiger.New())
-		leaf := tiger.New()
-
-		leafChunk := make([]byte, 1025)
-		leafChunk[0] = 0
-		fileChunk := leafChunk[1:]
-
-		var n int
-		for err == nil {
-			n, err = file.Read(fileChunk)
-			if n > 0 {
-				leaf.Write(leafChunk[:n+1])
-				tree.Write(leaf.Sum(nil))
-				leaf.Reset()
-			}
-		}
+	}
+	out, err := newFormatter(*format, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-		if err != nil && err != io.EOF {
-			fmt.Fprintln(os.Stderr, "Error hashing", info.Name()+",", err)
+	status := 0
+	for j := range hashFiles(collect(flag.Args()), *workers) {
+		if j.err != nil {
+			fmt.Fprintln(os.Stderr, "Error hashing", j.path+",", j.err)
+			status = 1
 			continue
 		}
-
-		hash := base32.StdEncoding.EncodeToString(tree.Sum(nil))
-		hash = hash[:len(hash)-1] // Trim the trailing '='
-		magnet := fmt.Sprintf("magnet:?dn=%s&xl=%d&xt=urn:tree:tiger:%s", url.QueryEscape(info.Name()), info.Size(), hash)
-		if *exactSource != "" {
-			magnet = magnet + "&xs=" + *exactSource
+		if err = out.add(j); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		fmt.Fprintln(os.Stdout, magnet)
 	}
-	os.Exit(0)
+	if err = out.close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = cache.save(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing cache", *cachePath+":", err)
+		os.Exit(1)
+	}
+	os.Exit(status)
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/3M3RY/go-adc/adc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// as many leaves as a Share keeps when no -block-size is given
+const defaultLeaves = 512
+
+// the suffix of leaf data written beside a file
+const tthlSuffix = ".tthl"
+
+// wantLeaves reports whether leaf data is to be written.
+func wantLeaves() bool {
+	return *tthl || *tthlDir != ""
+}
+
+// leafBlockSize returns the size of the blocks covered by
+// each leaf kept for a file of the given size.
+func leafBlockSize(size int64) int64 {
+	if *blockSize != 0 {
+		return *blockSize
+	}
+	return int64(adc.LeafBlockSize(uint64(size), defaultLeaves))
+}
+
+// checkBlockSize fails unless -block-size is 1024 bytes
+// multiplied by a power of two, or zero.
+func checkBlockSize() {
+	b := *blockSize
+	if b == 0 {
+		return
+	}
+	if b < 1024 || b&(b-1) != 0 {
+		fmt.Fprintln(os.Stderr, "-block-size must be 1024 multiplied by a power of two")
+		os.Exit(1)
+	}
+}
+
+// writeLeaves saves the leaves of a file, each 24 byte hash one after
+// another, as a peer sends them in answer to GET tthl. They go beside
+// the file with -tthl and are named by the root hash in -tthl-dir.
+func writeLeaves(j *hashJob, leaves [][]byte) error {
+	b := bytes.Join(leaves, nil)
+	if *tthl {
+		if err := ioutil.WriteFile(j.path+tthlSuffix, b, 0644); err != nil {
+			return err
+		}
+	}
+	if *tthlDir != "" {
+		if err := os.MkdirAll(*tthlDir, 0755); err != nil {
+			return err
+		}
+		name := filepath.Join(*tthlDir, j.tth.String()+tthlSuffix)
+		if err := ioutil.WriteFile(name, b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright © 2013 Emery Hemingway
+
+package main
+
+import (
+	"fmt"
+	"github.com/3M3RY/go-adc/adc"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a health check waits for a hub to answer
+const pingTimeout = 10 * time.Second
+
+// A pool is a group of hubs that clients are shared among. Each hub
+// is pinged now and then, and those that cannot be reached or are
+// full are passed over until they recover.
+type pool struct {
+	name    string
+	mu      sync.Mutex
+	members []*member
+}
+
+type member struct {
+	url      string
+	weight   int
+	healthy  bool
+	users    int // as last pinged, plus the clients sent since
+	maxUsers int // zero if unknown
+	current  int // for smooth weighted round-robin
+}
+
+// parseMember reads a target and an optional weight.
+func parseMember(fields []string) (*member, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no target given")
+	}
+	m := &member{url: fields[0], weight: 1, healthy: true}
+	if _, err := url.Parse(m.url); err != nil {
+		return nil, err
+	}
+	if len(fields) > 1 {
+		w, err := strconv.Atoi(fields[1])
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("bad weight %q", fields[1])
+		}
+		m.weight = w
+	}
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("unexpected %q after weight", fields[2])
+	}
+	return m, nil
+}
+
+// available reports whether a member may be sent clients.
+func (m *member) available() bool {
+	return m.healthy && (m.maxUsers == 0 || m.users < m.maxUsers)
+}
+
+// pick chooses the hub for a client, by -balance.
+func (p *pool) pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ms []*member
+	for _, m := range p.members {
+		if m.available() {
+			ms = append(ms, m)
+		}
+	}
+	if len(ms) == 0 {
+		// better to send clients somewhere than nowhere
+		ms = p.members
+	}
+
+	var best *member
+	switch *balance {
+	case "least-users":
+		for _, m := range ms {
+			if best == nil || m.users*best.weight < best.users*m.weight {
+				best = m
+			}
+		}
+	default:
+		total := 0
+		for _, m := range ms {
+			m.current += m.weight
+			total += m.weight
+			if best == nil || m.current > best.current {
+				best = m
+			}
+		}
+		best.current -= total
+	}
+	best.users++
+	return best.url
+}
+
+// watch pings each member of the pool every interval until stop is closed.
+func (p *pool) watch(interval time.Duration, stop chan struct{}) {
+	for _, m := range p.members {
+		go p.check(m, interval, stop)
+	}
+}
+
+func (p *pool) check(m *member, interval time.Duration, stop chan struct{}) {
+	u, _ := url.Parse(m.url)
+	for {
+		info, err := adc.PingTimeout(u, pingTimeout)
+		p.mu.Lock()
+		was := m.healthy
+		switch err {
+		case nil:
+			m.healthy = true
+			m.users = pingValue(info, "UC")
+			m.maxUsers = pingValue(info, "MC")
+		case adc.ErrNoPing:
+			// reachable, but there is no telling how full it is
+			m.healthy = true
+		default:
+			m.healthy = false
+		}
+		now := m.healthy
+		p.mu.Unlock()
+		if was != now {
+			if now {
+				log.Printf("%s is back in pool %s", m.url, p.name)
+			} else {
+				log.Printf("%s removed from pool %s: %s", m.url, p.name, err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func pingValue(info map[string]*adc.ParameterValue, key string) int {
+	v, ok := info[key]
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.Atoi(v.String())
+	return n
+}
+
+// targetList collects repeated -target flags, each a hub URL
+// optionally followed by a space and a weight.
+type targetList []string
+
+func (l *targetList) String() string { return strings.Join(*l, ",") }
+
+func (l *targetList) Set(s string) error {
+	if _, err := parseMember(strings.Fields(s)); err != nil {
+		return err
+	}
+	*l = append(*l, s)
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright © 2013 Emery Hemingway
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A config is everything read from the message and rules files. It
+// is replaced whole on reload, and each client keeps the one that
+// was current when it arrived.
+type config struct {
+	actions []action
+	rules   *ruleSet
+	stop    chan struct{} // closed to end the health checks of the pools
+}
+
+var (
+	current     atomic.Value // *config
+	configMu    sync.Mutex   // held while replacing current
+	errNoTarget = errors.New("no redirect target specified")
+)
+
+func currentConfig() *config {
+	return current.Load().(*config)
+}
+
+// setConfig makes cfg current and starts its health checks,
+// stopping those of the config it replaces.
+func setConfig(cfg *config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	cfg.stop = make(chan struct{})
+	cfg.rules.watch(*checkInterval, cfg.stop)
+	if old, ok := current.Load().(*config); ok {
+		close(old.stop)
+	}
+	current.Store(cfg)
+}
+
+// loadConfig reads the message and rules files.
+func loadConfig() (*config, error) {
+	cfg := new(config)
+	cfg.rules = &ruleSet{pools: make(map[string]*pool)}
+	if *rulesFilename != "" {
+		rulesFile, err := os.Open(*rulesFilename)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing rules, %s", err)
+		}
+		cfg.rules, err = parseRules(rulesFile)
+		rulesFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing rules, %s", err)
+		}
+	}
+	rules := cfg.rules
+	if rules.def == "" && len(targets) > 0 {
+		rules.defPool = &pool{name: "-target"}
+		for _, t := range targets {
+			m, _ := parseMember(strings.Fields(t))
+			rules.defPool.members = append(rules.defPool.members, m)
+		}
+	}
+	if rules.nmdcDef == "" {
+		rules.nmdcDef = *nmdcTarget
+	}
+	for _, ru := range append(rules.rules, &rule{target: rules.def}, &rule{target: rules.nmdcDef}) {
+		if strings.Contains(ru.target, "://") {
+			continue
+		}
+		if _, ok := rules.pools[ru.target]; !ok && ru.target != "" {
+			return nil, fmt.Errorf("no pool named %s", ru.target)
+		}
+	}
+	if rules.def == "" && rules.defPool == nil {
+		return nil, errNoTarget
+	}
+
+	if *messageFilename != "" {
+		msgFile, err := os.Open(*messageFilename)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing message, %s", err)
+		}
+		cfg.actions, err = parseMessage(msgFile)
+		msgFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing message, %s", err)
+		}
+	}
+	return cfg, nil
+}
+
+func parseMessage(msgFile io.Reader) ([]action, error) {
+	var actions []action
+	r := bufio.NewReader(msgFile)
+	for {
+		s, err := r.ReadString('\n')
+		s = strings.Replace(s, "\n", "", -1)
+		if err != nil {
+			if err == io.EOF {
+				break
+			} else {
+				return nil, err
+			}
+		}
+
+		if len(s) > 1 && s[0] == uint8('!') {
+			d, err := time.ParseDuration(s[1:])
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, &sleepAction{d})
+			continue
+		}
+
+		s = strings.Replace(s, " ", "\\s", -1)
+		if strings.Contains(s, "%") {
+			actions = append(actions, &formatAction{s})
+			continue
+		}
+		actions = append(actions, &msgAction{s})
+	}
+	return actions, nil
+}
+
+// reload replaces the current config, unless the
+// files cannot be read, in which case it is kept.
+func reload() {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Println("not reloading,", err)
+		return
+	}
+	setConfig(cfg)
+	log.Println("reloaded")
+}
+
+func reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		reload()
+	}
+}
+
+// watchFiles reloads when the message or rules file is modified.
+func watchFiles(interval time.Duration) {
+	modTimes := func() (ts []time.Time) {
+		for _, name := range []string{*messageFilename, *rulesFilename} {
+			var t time.Time
+			if name != "" {
+				if info, err := os.Stat(name); err == nil {
+					t = info.ModTime()
+				}
+			}
+			ts = append(ts, t)
+		}
+		return ts
+	}
+	last := modTimes()
+	for {
+		time.Sleep(interval)
+		ts := modTimes()
+		for i := range ts {
+			if !ts[i].Equal(last[i]) {
+				reload()
+				break
+			}
+		}
+		last = ts
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright © 2013 Emery Hemingway
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"github.com/3M3RY/go-adc/adc"
+	"net"
+	"strings"
+	"time"
+)
+
+// how long a client on an auto listener has to start talking
+const sniffTimeout = 10 * time.Second
+
+// the first byte of a TLS record carrying a handshake
+const tlsHandshake = 0x16
+
+// listenList collects repeated -listen flags.
+type listenList []string
+
+func (l *listenList) String() string { return strings.Join(*l, ",") }
+
+func (l *listenList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// A listener accepts clients on an address, in plain text,
+// over TLS, or either as each client chooses.
+type listener struct {
+	net.Listener
+	mode string // "plain", "tls" or "auto"
+}
+
+// listen opens a -listen address, ADDRESS for plain text,
+// tls:ADDRESS for TLS and auto:ADDRESS for either.
+func listen(spec string, config *tls.Config) (*listener, error) {
+	mode, addr := "plain", spec
+	if i := strings.Index(spec, ":"); i > 0 {
+		switch spec[:i] {
+		case "tls", "auto":
+			mode, addr = spec[:i], spec[i+1:]
+		}
+	}
+	if mode != "plain" && config == nil {
+		return nil, fmt.Errorf("%s needs -cert and -key", spec)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if mode == "tls" {
+		ln = tls.NewListener(ln, config)
+	}
+	return &listener{ln, mode}, nil
+}
+
+func (ln *listener) serve(config *tls.Config) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		switch {
+		case ln.mode == "auto":
+			go sniff(conn, config)
+		case ln.mode == "plain" && *nmdcWait > 0:
+			go sniff(conn, nil)
+		default:
+			go handleConnection(conn)
+		}
+	}
+}
+
+// sniff looks at the first byte from a client to tell a TLS
+// handshake from a plain text HSUP, if config is given, and
+// greets a client that sends nothing as NMDC, if -nmdc-wait is.
+func sniff(nc net.Conn, config *tls.Config) {
+	r := bufio.NewReader(nc)
+	wait := sniffTimeout
+	if *nmdcWait > 0 {
+		wait = *nmdcWait
+	}
+	nc.SetReadDeadline(time.Now().Add(wait))
+	b, err := r.Peek(1)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && *nmdcWait > 0 {
+		nc.SetReadDeadline(time.Time{})
+		handleNMDC(&peekedConn{nc, r})
+		return
+	}
+	if err != nil {
+		nc.Close()
+		return
+	}
+	nc.SetReadDeadline(time.Time{})
+	conn := &peekedConn{nc, r}
+	if b[0] == tlsHandshake && config != nil {
+		handleConnection(tls.Server(conn, config))
+	} else {
+		handleConnection(conn)
+	}
+}
+
+// peekedConn is a connection that has been read from
+// through r, which holds what was read but not used.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// keyPrint returns the KEYP keyprint of a certificate, as
+// clients give it in the kp parameter of an adcs:// URL.
+func keyPrint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return "SHA256/" + adc.Base32EncodeString(sum[:])
+}
@@ -3,11 +3,9 @@
 package main
 
 import (
-	"bufio"
 	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
@@ -18,25 +16,53 @@ import (
 import "github.com/3M3RY/go-adc/adc"
 
 var (
-	port            = flag.Int("port", 1511, "port to listen for incoming connections on")
+	port            = flag.Int("port", 1511, "port to listen for incoming connections on, unless -listen is given")
 	messageFilename = flag.String("message", "", "file containing a message to send to clients")
-	target          = flag.String("target", "", "hub to redirect clients to")
+	balance         = flag.String("balance", "round-robin", "how to share clients among the hubs of a pool, round-robin or least-users")
+	checkInterval   = flag.Duration("check-interval", time.Minute, "how often to ping the hubs of a pool")
+	rulesFilename   = flag.String("rules", "", "file of rules choosing the hub to redirect each client to")
 	certFilename    = flag.String("cert", "", "TLS certificate file")
 	keyFilename     = flag.String("key", "", "TLS key file")
 	logRedirects    = flag.Bool("log", false, "log clients to Stdout")
+	watchInterval   = flag.Duration("watch", 0, "how often to check the message and rules files for changes, zero to only reload on SIGHUP")
+	nmdcWait        = flag.Duration("nmdc-wait", 2*time.Second, "how long a client on a plain or auto listener may stay silent before it is greeted as NMDC, zero for ADC only")
+	nmdcTarget      = flag.String("nmdc-target", "", "hub to redirect NMDC clients to, if not the same as for ADC clients")
 	redirectLog     *log.Logger
-	actions         []action
+	targets         targetList
+	listens         listenList
+	keyprint        string // of the TLS certificate, if any
 )
 
+func init() {
+	flag.Var(&listens, "listen", "address to listen on, prefixed with tls: for TLS or auto: for either, may be given more than once")
+	flag.Var(&targets, "target", "hub to redirect clients to, with an optional weight after a space, may be given more than once")
+}
+
 type funcConfig struct {
 	f func(c *clientConfig, d time.Duration)
 	d time.Duration
 }
 
 type clientConfig struct {
-	nick string
-	ip   string
-	conn *adc.Conn
+	nick   string
+	ip     string
+	addr   net.IP
+	cid    string
+	ve     string
+	ap     string
+	tls    bool
+	target string
+	conn   *adc.Conn
+	nmdc   net.Conn // in place of conn for an NMDC client
+}
+
+// message sends a line of the message, escaped as for ADC.
+func (c *clientConfig) message(s string) {
+	if c.nmdc != nil {
+		nmdcChat(c, s)
+		return
+	}
+	c.conn.WriteLine("IMSG %s", s)
 }
 
 type action interface {
@@ -54,11 +80,12 @@ type formatAction struct {
 }
 
 func (a formatAction) run(c *clientConfig) {
-	a.s = strings.Replace(a.s, "%t", *target, -1)
+	a.s = strings.Replace(a.s, "%t", c.target, -1)
 	a.s = strings.Replace(a.s, "%n", c.nick, -1)
 	a.s = strings.Replace(a.s, "%a", c.ip, -1)
+	a.s = strings.Replace(a.s, "%k", keyprint, -1)
 	a.s = strings.Replace(a.s, "%%", "%", -1)
-	c.conn.WriteLine("IMSG %s", a.s)
+	c.message(a.s)
 }
 
 type msgAction struct {
@@ -66,63 +93,39 @@ type msgAction struct {
 }
 
 func (a *msgAction) run(c *clientConfig) {
-	c.conn.WriteLine("IMSG %s", a.s)
+	c.message(a.s)
 }
 	
 
 func main() {
 	flag.Parse()
-	if *target == "" {
+	if *balance != "round-robin" && *balance != "least-users" {
+		fmt.Println("unknown balance", *balance)
+		os.Exit(-1)
+	}
+	cfg, err := loadConfig()
+	if err == errNoTarget {
 		fmt.Println("no redirect target specified")
 		flag.Usage()
 		fmt.Print("\n")
 		messageUsage()
+		fmt.Print("\n")
+		rulesUsage()
 		os.Exit(-1)
 	}
-
-	if *messageFilename != "" {
-		msgFile, err := os.Open(*messageFilename)
-		if err != nil {
-			fmt.Println("Error parsing message,", err)
-			os.Exit(-1)
-		}
-		r := bufio.NewReader(msgFile)
-		for {
-			s, err := r.ReadString('\n')
-			s = strings.Replace(s, "\n", "", -1)
-			if err != nil {
-				if err == io.EOF {
-					break
-				} else {
-					fmt.Println("Error parsing message,", err)
-					os.Exit(-1)
-				}
-			}
-
-			if len(s) > 1 && s[0] == uint8('!') {
-				d, err := time.ParseDuration(s[1:])
-				if err != nil {
-					fmt.Println("Error parsing message,", err)
-					os.Exit(-1)
-				}
-				actions = append(actions, &sleepAction{d})
-				continue
-			}
-
-			s = strings.Replace(s, " ", "\\s", -1)
-			if strings.Contains(s, "%") {
-				actions = append(actions, &formatAction{s})
-				continue
-			}
-			actions = append(actions, &msgAction{s})
-		}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	setConfig(cfg)
+	go reloadOnSignal()
+	if *watchInterval > 0 {
+		go watchFiles(*watchInterval)
 	}
 
 	if *logRedirects {
 		redirectLog = log.New(os.Stdout, log.Prefix(), log.Flags())
 	}
-	var ln net.Listener
-	var err error
 	if *certFilename != "" && *keyFilename == "" {
 		fmt.Println("missing key argument")
 		flag.Usage()
@@ -134,29 +137,39 @@ func main() {
 		os.Exit(-1)
 	}
 
-	if *certFilename == "" && *keyFilename == "" {
-		ln, err = net.Listen("tcp", fmt.Sprintf(":%d", *port))
-	} else {
+	var config *tls.Config
+	if *certFilename != "" {
 		cert, err := tls.LoadX509KeyPair(*certFilename, *keyFilename)
 		if err != nil {
 			fmt.Println("TLS error:", err)
 			os.Exit(-1)
 		}
-		config := &tls.Config{Certificates: []tls.Certificate{cert}}
-		ln, err = tls.Listen("tcp", fmt.Sprintf(":%d", *port), config)
+		config = &tls.Config{Certificates: []tls.Certificate{cert}}
+		keyprint = keyPrint(cert)
+		fmt.Println("keyprint", keyprint)
 	}
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+
+	if len(listens) == 0 {
+		// as before there was -listen
+		if config != nil {
+			listens = listenList{fmt.Sprintf("tls::%d", *port)}
+		} else {
+			listens = listenList{fmt.Sprintf(":%d", *port)}
+		}
 	}
-	for {
-		conn, err := ln.Accept()
+	var lns []*listener
+	for _, spec := range listens {
+		ln, err := listen(spec, config)
 		if err != nil {
 			fmt.Println(err)
-			continue
+			os.Exit(-1)
 		}
-		go handleConnection(conn)
+		lns = append(lns, ln)
 	}
+	for _, ln := range lns[1:] {
+		go ln.serve(config)
+	}
+	lns[0].serve(config)
 }
 
 func messageUsage() {
@@ -165,6 +178,7 @@ func messageUsage() {
 	fmt.Println("\t %t - the redirect taget")
 	fmt.Println("\t %n - Nickname of the user")
 	fmt.Println("\t %a - IP address of the user")
+	fmt.Println("\t %k - keyprint of the TLS certificate, for the kp parameter of an adcs:// URL")
 	fmt.Println("\t %% - Becomes '%'")
 	fmt.Println("A line starting with '!' followed by a number and a unit suffix will")
 	fmt.Println("instruct the redirector to wait before continuing. Valid time units are")
@@ -184,7 +198,12 @@ func handleConnection(nc net.Conn) {
 	}
 	conn.WriteLine("ISUP ADBASE ADTIGR")
 	conn.WriteLine("ISID AAAX")
-	conn.WriteLine("IINF CT32 NIRedirector VEgo-adc\\sredirector\\s0.1")
+	if _, ok := nc.(*tls.Conn); ok && keyprint != "" {
+		// the KEYP extension, so that clients may pin the certificate
+		conn.WriteLine("IINF CT32 NIRedirector VEgo-adc\\sredirector\\s0.1 KP%s", keyprint)
+	} else {
+		conn.WriteLine("IINF CT32 NIRedirector VEgo-adc\\sredirector\\s0.1")
+	}
 
 	msg, err = conn.ReadMessage()
 	if err != nil {
@@ -194,27 +213,47 @@ func handleConnection(nc net.Conn) {
 		return
 	}
 
+	// a reload part way through does not change what this client sees
+	cfg := currentConfig()
+
 	var id string
 	c := &clientConfig{ip:nc.RemoteAddr().String(), conn:conn}
+	if host, _, err := net.SplitHostPort(c.ip); err == nil {
+		c.addr = net.ParseIP(host)
+	}
+	_, c.tls = nc.(*tls.Conn)
 	for _, field := range msg.Params[1:] {
+		if len(field) < 2 {
+			continue
+		}
 		switch field[:2] {
 		case "ID":
 			id = field[2:]
-			if c.nick != "" {
-				break
-			}
+			c.cid = id
 		case "NI":
 			c.nick = field[2:]
-			if id != "" {
-				break
-			}
+		case "VE":
+			c.ve = unescape(field[2:])
+		case "AP":
+			c.ap = unescape(field[2:])
 		}
 	}
+	c.target = cfg.rules.match(c, time.Now())
 	if *logRedirects {
-		redirectLog.Println(id, c.ip, c.nick)
+		redirectLog.Println(id, c.ip, c.nick, c.target)
 	}
-	for _, a := range actions {
+	for _, a := range cfg.actions {
 		a.run(c)
 	}
-	conn.WriteLine("IQUI AAAX RD%s", *target)
+	conn.WriteLine("IQUI AAAX RD%s", c.target)
+}
+
+// unescape returns an INF value as the client meant it.
+func unescape(s string) string {
+	return fmt.Sprintf("%s", adc.NewParameterValue(s))
+}
+
+// escape returns s as it would be sent in an INF.
+func escape(s string) string {
+	return fmt.Sprintf("%v", adc.NewParameterValue(s))
 }
@@ -0,0 +1,70 @@
+// Copyright © 2013 Emery Hemingway
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// NMDC clients wait for the hub to send $Lock, where ADC clients
+// send HSUP at once, so a client that is silent for -nmdc-wait is
+// taken to be NMDC.
+
+var nmdcEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"$", "&#36;",
+	"|", "&#124;")
+
+// how long an NMDC client has to give its nick
+const nmdcTimeout = 30 * time.Second
+
+// handleNMDC greets an NMDC client, reads its nick and moves it on.
+func handleNMDC(nc net.Conn) {
+	defer nc.Close()
+	fmt.Fprint(nc, "$Lock EXTENDEDPROTOCOL_go-adc_redirector Pk=go-adc-redirector|")
+	fmt.Fprint(nc, "$HubName Redirector|")
+
+	// $Supports and $Key come before $ValidateNick, the key is
+	// not checked as there is nothing here to protect
+	nc.SetReadDeadline(time.Now().Add(nmdcTimeout))
+	r := bufio.NewReader(nc)
+	var nick string
+	for nick == "" {
+		cmd, err := r.ReadString('|')
+		if err != nil {
+			return
+		}
+		if strings.HasPrefix(cmd, "$ValidateNick ") {
+			nick = strings.TrimSuffix(cmd[len("$ValidateNick "):], "|")
+		}
+	}
+	nc.SetReadDeadline(time.Time{})
+
+	// kept escaped, as an ADC client sends it in NI
+	c := &clientConfig{
+		ip:   nc.RemoteAddr().String(),
+		nick: escape(nick),
+		nmdc: nc,
+	}
+	if host, _, err := net.SplitHostPort(c.ip); err == nil {
+		c.addr = net.ParseIP(host)
+	}
+	cfg := currentConfig()
+	c.target = cfg.rules.match(c, time.Now())
+	if *logRedirects {
+		redirectLog.Println("NMDC", c.ip, c.nick, c.target)
+	}
+	for _, a := range cfg.actions {
+		a.run(c)
+	}
+	fmt.Fprintf(nc, "$ForceMove %s|", nmdcEscaper.Replace(c.target))
+}
+
+// nmdcChat sends a line of the message as chat from the redirector.
+func nmdcChat(c *clientConfig, s string) {
+	fmt.Fprintf(c.nmdc, "<Redirector> %s|", nmdcEscaper.Replace(unescape(s)))
+}
@@ -0,0 +1,222 @@
+// Copyright © 2013 Emery Hemingway
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A rule sends the clients that meet all of its conditions to target.
+type rule struct {
+	conds  []condition
+	target string
+}
+
+// A condition tests a client at a given time.
+type condition func(c *clientConfig, now time.Time) bool
+
+// A ruleSet is a list of rules, the first to match a client
+// chooses its target, and def is used when none match, or
+// nmdcDef for NMDC clients if there is one. A target may name
+// a pool rather than a hub.
+type ruleSet struct {
+	rules   []*rule
+	def     string
+	nmdcDef string
+	defPool *pool // the -target hubs, when there is no def
+	pools   map[string]*pool
+}
+
+func rulesUsage() {
+	fmt.Println("A rules file holds one rule per line, any number of conditions")
+	fmt.Println("followed by the hub to send matching clients to. The first rule")
+	fmt.Println("to match is used. Lines starting with '#' are ignored.")
+	fmt.Println("\t ip ADDRESS[/BITS]  the client address is within a network")
+	fmt.Println("\t nick REGEXP        the nick matches")
+	fmt.Println("\t cid CID            the client ID is")
+	fmt.Println("\t ve REGEXP          the client version (VE) matches")
+	fmt.Println("\t ap REGEXP          the client application (AP) matches")
+	fmt.Println("\t tls yes|no         the client did or did not connect with TLS")
+	fmt.Println("\t nmdc yes|no        the client does or does not speak NMDC rather than ADC")
+	fmt.Println("\t time HH:MM-HH:MM   the local time is within a span, which may cross midnight")
+	fmt.Println("A line of 'default TARGET' gives the hub for clients no rule matches,")
+	fmt.Println("and 'nmdc-default TARGET' that for NMDC clients, in place of -nmdc-target.")
+	fmt.Println("Lines of 'pool NAME URL [WEIGHT]' add hubs to a pool that may be")
+	fmt.Println("given as a target, clients are shared among the healthy hubs of a pool.")
+	fmt.Println("\t ip 192.168.0.0/16 adc://lan-hub:1511")
+	fmt.Println("\t tls no time 18:00-06:00 adc://night.example.com:1511")
+	fmt.Println("\t pool public adcs://a.example.com:1511 3")
+	fmt.Println("\t pool public adcs://b.example.com:1511")
+	fmt.Println("\t default public")
+}
+
+// parseRules reads a rules file.
+func parseRules(r io.Reader) (*ruleSet, error) {
+	rs := &ruleSet{pools: make(map[string]*pool)}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || fields[0][0] == '#' {
+			continue
+		}
+		if fields[0] == "default" || fields[0] == "nmdc-default" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: %s takes a target", n, fields[0])
+			}
+			if fields[0] == "default" {
+				rs.def = fields[1]
+			} else {
+				rs.nmdcDef = fields[1]
+			}
+			continue
+		}
+		if fields[0] == "pool" {
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("line %d: pool takes a name and a target", n)
+			}
+			m, err := parseMember(fields[2:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			p := rs.pools[fields[1]]
+			if p == nil {
+				p = &pool{name: fields[1]}
+				rs.pools[p.name] = p
+			}
+			p.members = append(p.members, m)
+			continue
+		}
+		if len(fields)%2 != 1 {
+			return nil, fmt.Errorf("line %d: conditions must each have a value and be followed by a target", n)
+		}
+		ru := &rule{target: fields[len(fields)-1]}
+		for i := 0; i < len(fields)-1; i += 2 {
+			cond, err := parseCondition(fields[i], fields[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			ru.conds = append(ru.conds, cond)
+		}
+		rs.rules = append(rs.rules, ru)
+	}
+	return rs, s.Err()
+}
+
+func parseCondition(key, value string) (condition, error) {
+	switch key {
+	case "ip":
+		if !strings.Contains(value, "/") {
+			if strings.Contains(value, ":") {
+				value += "/128"
+			} else {
+				value += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *clientConfig, _ time.Time) bool {
+			return c.addr != nil && network.Contains(c.addr)
+		}, nil
+
+	case "nick", "ve", "ap":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *clientConfig, _ time.Time) bool {
+			switch key {
+			case "nick":
+				return re.MatchString(unescape(c.nick))
+			case "ve":
+				return re.MatchString(c.ve)
+			}
+			return re.MatchString(c.ap)
+		}, nil
+
+	case "cid":
+		return func(c *clientConfig, _ time.Time) bool {
+			return strings.EqualFold(c.cid, value)
+		}, nil
+
+	case "tls", "nmdc":
+		var want bool
+		switch value {
+		case "yes", "true":
+			want = true
+		case "no", "false":
+		default:
+			return nil, fmt.Errorf("%s must be yes or no, not %q", key, value)
+		}
+		return func(c *clientConfig, _ time.Time) bool {
+			if key == "nmdc" {
+				return (c.nmdc != nil) == want
+			}
+			return c.tls == want
+		}, nil
+
+	case "time":
+		var h1, m1, h2, m2 int
+		_, err := fmt.Sscanf(value, "%d:%d-%d:%d", &h1, &m1, &h2, &m2)
+		if err != nil || h1 > 23 || h2 > 23 || m1 > 59 || m2 > 59 {
+			return nil, fmt.Errorf("bad time span %q", value)
+		}
+		from, to := h1*60+m1, h2*60+m2
+		return func(_ *clientConfig, now time.Time) bool {
+			t := now.Hour()*60 + now.Minute()
+			if from <= to {
+				return from <= t && t < to
+			}
+			return t >= from || t < to
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown condition %q", key)
+}
+
+// match returns the target for a client.
+func (rs *ruleSet) match(c *clientConfig, now time.Time) string {
+	for _, ru := range rs.rules {
+		ok := true
+		for _, cond := range ru.conds {
+			if !cond(c, now) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return rs.target(ru.target)
+		}
+	}
+	if c.nmdc != nil && rs.nmdcDef != "" {
+		return rs.target(rs.nmdcDef)
+	}
+	if rs.def == "" && rs.defPool != nil {
+		return rs.defPool.pick()
+	}
+	return rs.target(rs.def)
+}
+
+// target returns a hub of the pool named by t, or t itself.
+func (rs *ruleSet) target(t string) string {
+	if p, ok := rs.pools[t]; ok {
+		return p.pick()
+	}
+	return t
+}
+
+// watch starts the health checks of every pool.
+func (rs *ruleSet) watch(interval time.Duration, stop chan struct{}) {
+	for _, p := range rs.pools {
+		p.watch(interval, stop)
+	}
+	if rs.defPool != nil {
+		rs.defPool.watch(interval, stop)
+	}
+}
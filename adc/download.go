@@ -1,10 +1,12 @@
 package adc
 
 import (
-	"compress/zlib"
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
 	"sync"
 	"time"
 )
@@ -14,22 +16,58 @@ type fileChunk struct {
 	size  uint64
 }
 
+// the largest chunk a worker will request, and so hold in memory
+const maxChunkSize = 1 << 24
+
 type DownloadConfig struct {
 	OutputFilename string
+	// Output, if set, is written to rather than OutputFilename.
+	Output         io.WriterAt
 	SearchFilename string
 	Hash           *TigerTreeHash
 	Verify         bool
 	Compress       bool
+	// Size, if known, lets the download begin without waiting for
+	// a peer to report it, but then no hash tree is fetched and
+	// chunks are not verified as they arrive.
+	Size uint64
+	// WebSources are HTTP URLs of the same file, fetched with
+	// range requests alongside any peers. They require Size.
+	WebSources []string
+}
+
+// Progress is a snapshot of the state of a download.
+type Progress struct {
+	Size     uint64             // size of the file
+	Done     uint64             // bytes written
+	Verified uint64             // bytes verified against the hash tree
+	Sources  int                // peers currently transferring
+	Peers    map[string]float64 // bytes per second of the last chunk, by nick
+	Elapsed  time.Duration
+	ETA      time.Duration // zero when unknown
 }
 
 type DownloadDispatcher struct {
 	config     *DownloadConfig
 	resultChan chan *SearchResult
 	finalChan  chan uint64
-	file       *os.File
+	progress   chan *Progress
+	output     io.WriterAt
+	file       *os.File // nil unless we created it
 	fileSeek   uint64
 	fileSize   uint64
+	leaves     [][]byte
+	blockSize  uint64
+	retry      []*fileChunk
+	done       uint64
+	verified   uint64
+	sources    int
+	rates      map[string]float64
+	started    time.Time
+	deadline   time.Time // no new sources are expected after this
+	finished   bool
 	chunkMu    sync.Mutex
+	chunkCond  *sync.Cond // signalled as chunks are done or returned
 	log        *log.Logger
 }
 
@@ -38,13 +76,15 @@ func NewDownloadDispatcher(config *DownloadConfig, logger *log.Logger) (*Downloa
 		config:     config,
 		resultChan: make(chan *SearchResult, 32), // buffered to keep from blocking at the hub
 		finalChan:  make(chan uint64, 1),
+		rates:      make(map[string]float64),
 		log:        logger,
 	}
+	d.chunkCond = sync.NewCond(&d.chunkMu)
 	d.chunkMu.Lock()
 	return d, nil
 }
 
-func (d DownloadDispatcher) ResultChannel() chan *SearchResult {
+func (d *DownloadDispatcher) ResultChannel() chan *SearchResult {
 	return d.resultChan
 }
 
@@ -52,11 +92,34 @@ func (d *DownloadDispatcher) FinalChannel() chan uint64 {
 	return d.finalChan
 }
 
+// SetProgressChannel sets a channel to receive a Progress after
+// each completed chunk. Sends do not block, so a slow receiver
+// will miss updates rather than stall the download.
+func (d *DownloadDispatcher) SetProgressChannel(c chan *Progress) {
+	d.progress = c
+}
+
 func (d *DownloadDispatcher) Run(timeout time.Duration) {
 	stop := time.After(timeout)
+	d.deadline = time.Now().Add(timeout)
 
 	var result *SearchResult
-	if d.config.Hash == nil {
+	if d.config.Size != 0 {
+		d.fileSize = d.config.Size
+		for _, u := range d.config.WebSources {
+			go webWorker(d, u)
+		}
+		// there is no waiting for a peer here, so fail
+		// at the deadline if none has turned up by then
+		go func() {
+			<-stop
+			d.chunkMu.Lock()
+			if d.sources == 0 {
+				d.stalled()
+			}
+			d.chunkMu.Unlock()
+		}()
+	} else if d.config.Hash == nil {
 		select {
 		case <-stop:
 			d.finalChan <- 0
@@ -66,12 +129,6 @@ func (d *DownloadDispatcher) Run(timeout time.Duration) {
 			go downloadWorker(d, result)
 		}
 
-		go func() {
-			for result := range d.resultChan {
-				go downloadWorker(d, result)
-			}
-		}()
-
 	} else {
 		for d.fileSize == 0 {
 			select {
@@ -84,52 +141,82 @@ func (d *DownloadDispatcher) Run(timeout time.Duration) {
 				sessionId := peer.NextSessionId()
 				err := peer.StartSession(sessionId)
 				if err != nil {
-					fmt.Printf("Error: could not connect to %v for hash tree:\n", peer.Nick, err)
+					d.log.Printf("could not connect to %s for hash tree: %s", peer.Nick, err)
 					continue
 				}
 
-				_, err = peer.getTigerTreeHashLeaves(d.config.Hash)
+				leaves, err := peer.getTigerTreeHashLeaves(d.config.Hash)
 				peer.EndSession(sessionId)
 				if err != nil {
-					fmt.Printf("Error: could not get leaves from %v: %v\n", peer.Nick, err)
+					d.log.Printf("could not get leaves from %s: %s", peer.Nick, err)
 					continue
 				}
+				d.blockSize = LeafBlockSize(result.size, len(leaves))
+				if (result.size+d.blockSize-1)/d.blockSize != uint64(len(leaves)) {
+					d.log.Printf("%s sent %d leaves, too few for a size of %d", peer.Nick, len(leaves), result.size)
+					continue
+				}
+				d.leaves = leaves
 				d.fileSize = result.size
 				go downloadWorker(d, result)
 			}
 		}
+	}
 
-		go func() {
-			for result := range d.resultChan {
-				if result.size != d.fileSize {
-					_, err := result.peer.getTigerTreeHashLeaves(d.config.Hash)
-					if err != nil {
-						fmt.Printf("Error: could not get leaves from %v: %v\n", result.peer.Nick, err)
-						continue
-					} else {
-						panic("two hosts presented valid hash tree leaves but different file sizes")
-					}
-				}
-				go downloadWorker(d, result)
+	go func() {
+		for result := range d.resultChan {
+			if result.size != d.fileSize {
+				d.log.Printf("%s reported a size of %d rather than %d, ignoring", result.peer.Nick, result.size, d.fileSize)
+				continue
 			}
-		}()
-	}
+			go downloadWorker(d, result)
+		}
+	}()
 
-	var err error
-	d.file, err = os.Create(d.config.OutputFilename)
-	if err != nil {
-		d.log.Fatalln(err)
+	if d.config.Output != nil {
+		d.output = d.config.Output
+	} else {
+		var err error
+		d.file, err = os.Create(d.config.OutputFilename)
+		if err != nil {
+			d.log.Fatalln(err)
+		}
+		d.output = d.file
 	}
+	d.started = time.Now()
 	d.chunkMu.Unlock()
 }
 
+// getChunk returns the next chunk to fetch, those handed back by
+// other workers first, lowest offset first, as a stream needs them
+// in order. When streaming, it waits rather than hand out a chunk
+// too far past the end of the stream.
 func (d *DownloadDispatcher) getChunk(size uint64) *fileChunk {
 	d.chunkMu.Lock()
 	defer d.chunkMu.Unlock()
-	fmt.Print("\r", d.fileSeek, "/", d.fileSize)
-	if d.fileSeek == d.fileSize {
-		d.finalChan <- d.fileSize
-		return nil
+	for {
+		if n := len(d.retry); n > 0 {
+			low := 0
+			for i, c := range d.retry {
+				if c.start < d.retry[low].start {
+					low = i
+				}
+			}
+			c := d.retry[low]
+			d.retry[low] = d.retry[n-1]
+			d.retry = d.retry[:n-1]
+			return c
+		}
+		if d.fileSeek == d.fileSize {
+			return nil
+		}
+		o, ok := d.output.(*OrderedWriter)
+		if !ok || !o.ahead(int64(d.fileSeek)) {
+			break
+		}
+		// the chunk at the end of the stream is with another worker,
+		// which will either finish it or hand it back
+		d.chunkCond.Wait()
 	}
 
 	c := new(fileChunk)
@@ -146,9 +233,147 @@ func (d *DownloadDispatcher) getChunk(size uint64) *fileChunk {
 	return c
 }
 
+// returnChunk puts a chunk back to be fetched by another worker.
+func (d *DownloadDispatcher) returnChunk(c *fileChunk) {
+	d.chunkMu.Lock()
+	d.retry = append(d.retry, c)
+	d.chunkCond.Broadcast()
+	d.chunkMu.Unlock()
+}
+
+// chunkDone records a completed chunk and reports progress.
+func (d *DownloadDispatcher) chunkDone(c *fileChunk, verified bool, nick string, rate float64) {
+	d.chunkMu.Lock()
+	defer d.chunkMu.Unlock()
+	d.done += c.size
+	if verified {
+		d.verified += c.size
+	}
+	d.rates[nick] = rate
+	d.chunkCond.Broadcast()
+	if d.done == d.fileSize && !d.finished {
+		d.finished = true
+		d.closeFile()
+		d.finalChan <- d.fileSize
+	}
+	d.sendProgress()
+}
+
+// Sources returns the nicks of the peers that have sent data.
+func (d *DownloadDispatcher) Sources() []string {
+	d.chunkMu.Lock()
+	defer d.chunkMu.Unlock()
+	nicks := make([]string, 0, len(d.rates))
+	for nick := range d.rates {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// Partial reports whether the dispatcher created its output file
+// but did not complete it, leaving it with holes.
+func (d *DownloadDispatcher) Partial() bool {
+	d.chunkMu.Lock()
+	defer d.chunkMu.Unlock()
+	return d.file != nil && d.done != d.fileSize
+}
+
+func (d *DownloadDispatcher) addSource(delta int) {
+	d.chunkMu.Lock()
+	defer d.chunkMu.Unlock()
+	d.sources += delta
+	if d.sources == 0 {
+		d.stalled()
+	}
+}
+
+// stalled fails the download if there are no sources left
+// and the search has timed out, must be called with chunkMu held.
+func (d *DownloadDispatcher) stalled() {
+	if d.finished || d.done == d.fileSize {
+		return
+	}
+	wait := d.deadline.Sub(time.Now())
+	if wait > 0 {
+		time.AfterFunc(wait, func() {
+			d.chunkMu.Lock()
+			if d.sources == 0 {
+				d.stalled()
+			}
+			d.chunkMu.Unlock()
+		})
+		return
+	}
+	d.finished = true
+	d.closeFile()
+	d.finalChan <- 0
+}
+
+func (d *DownloadDispatcher) closeFile() {
+	if d.file != nil {
+		d.file.Close()
+	}
+}
+
+// sendProgress must be called with chunkMu held.
+func (d *DownloadDispatcher) sendProgress() {
+	if d.progress == nil {
+		return
+	}
+	p := &Progress{
+		Size:     d.fileSize,
+		Done:     d.done,
+		Verified: d.verified,
+		Sources:  d.sources,
+		Peers:    make(map[string]float64, len(d.rates)),
+		Elapsed:  time.Since(d.started),
+	}
+	for nick, rate := range d.rates {
+		p.Peers[nick] = rate
+	}
+	if p.Done > 0 && p.Done < p.Size {
+		rate := float64(p.Done) / p.Elapsed.Seconds()
+		p.ETA = time.Duration(float64(p.Size-p.Done) / rate * float64(time.Second))
+	}
+	select {
+	case d.progress <- p:
+	default:
+	}
+}
+
+// verifyChunk checks buf against the hash tree leaves, if any.
+func (d *DownloadDispatcher) verifyChunk(start uint64, buf []byte) (verified bool, err error) {
+	if d.leaves == nil {
+		return false, nil
+	}
+	if start%d.blockSize != 0 || (uint64(len(buf))%d.blockSize != 0 && start+uint64(len(buf)) != d.fileSize) {
+		return false, Error("chunk is not aligned to the hash tree")
+	}
+	for i := uint64(0); i < uint64(len(buf)); i += d.blockSize {
+		end := i + d.blockSize
+		if end > uint64(len(buf)) {
+			end = uint64(len(buf))
+		}
+		t := NewTreeHasher(int64(d.blockSize))
+		t.Write(buf[i:end])
+		if !bytes.Equal(t.Root(), d.leaves[(start+i)/d.blockSize]) {
+			return false, Error(fmt.Sprintf("data at offset %d failed verification", start+i))
+		}
+	}
+	return true, nil
+}
+
 func downloadWorker(d *DownloadDispatcher, r *SearchResult) {
 	p := r.peer
-	requestSize := uint64(65536)
+	d.addSource(1)
+	defer d.addSource(-1)
+
+	minSize := uint64(65536)
+	if d.blockSize > minSize {
+		minSize = d.blockSize
+	}
+	requestSize := minSize
 	for {
 		chunk := d.getChunk(requestSize)
 		if chunk == nil {
@@ -158,7 +383,8 @@ func downloadWorker(d *DownloadDispatcher, r *SearchResult) {
 		sessionId := p.NextSessionId()
 		err := p.StartSession(sessionId)
 		if err != nil {
-			d.log.Println("could not open session with %v: %s", p.Nick, err)
+			d.log.Printf("could not open session with %s: %s", p.Nick, err)
+			d.returnChunk(chunk)
 			return
 		}
 
@@ -172,104 +398,101 @@ func downloadWorker(d *DownloadDispatcher, r *SearchResult) {
 		err = p.conn.WriteLine(f, r.FullName, chunk.start, chunk.size)
 
 		if err != nil {
+			d.returnChunk(chunk)
 			p.EndSession(sessionId)
 			return
 		}
 
 		msg, err := p.conn.ReadMessage()
 		if err != nil {
+			d.returnChunk(chunk)
 			p.EndSession(sessionId)
 			return
 		}
 		var start uint64
 		var size uint64
 
-		var zl bool
 		switch msg.Cmd {
 		case "STA":
 			d.log.Println(msg)
+			d.returnChunk(chunk)
 			p.EndSession(sessionId)
 			return
 		case "SND":
+			// from here on a failure leaves data on the wire,
+			// and the connection must be dropped
 			if msg.Params[0] != "file" || msg.Params[1] != r.FullName {
 				p.conn.WriteLine("CSTA 140 invalid\\sarguments.")
+				d.returnChunk(chunk)
+				p.drop()
 				p.EndSession(sessionId)
 				return
 			}
 			fmt.Sscan(msg.Params[2], &start)
 			fmt.Sscan(msg.Params[3], &size)
-			if start < chunk.start || size > chunk.size {
+			if start != chunk.start || size > chunk.size || (d.leaves != nil && size != chunk.size) {
 				p.conn.WriteLine("CSTA 140 invalid\\sfile\\srange")
+				d.returnChunk(chunk)
+				p.drop()
 				p.EndSession(sessionId)
 				return
 			}
-			switch len(msg.Params) {
-			case 4:
-			case 5:
-				switch msg.Params[4] {
-				case "ZL0":
-				case "ZL1":
-					zl = true
-				default:
-					p.conn.WriteLine("CSTA 140 unknown\\sflags")
-					p.EndSession(sessionId)
-					return
-				}
-			default:
+			if len(msg.Params) > 5 {
 				p.conn.WriteLine("CSTA 140 unknown\\sflags")
+				d.returnChunk(chunk)
+				p.drop()
 				p.EndSession(sessionId)
 				return
-
 			}
 		default:
+			d.returnChunk(chunk)
 			p.EndSession(sessionId)
 			return
 		}
+		if size < chunk.size {
+			d.returnChunk(&fileChunk{chunk.start + size, chunk.size - size})
+			chunk.size = size
+		}
 		buf := make([]byte, size)
-		var pos int
 
 		startOfTransfer := time.Now()
-		if zl {
-			r, err := zlib.NewReader(p.conn.R)
-			if err != nil {
-				p.EndSession(sessionId)
-				return
-			}
-
-			for pos < int(size) {
-				n, err := r.Read(buf[pos:])
-				if err != nil {
-					p.conn.WriteLine("CSTA 150 %v", NewParameterValue(err.Error()))
-					p.EndSession(sessionId)
-					return
-				}
-				pos += n
-			}
-		} else {
-			for pos < int(size) {
-				n, err := p.conn.R.Read(buf[pos:])
-				if err != nil {
-					p.conn.WriteLine("CSTA 150 %v", NewParameterValue(err.Error()))
-					p.EndSession(sessionId)
-					return
-				}
-				pos += n
+		src, err := p.dataReader(msg.Params[4:], size)
+		if err == nil {
+			_, err = io.ReadFull(src, buf)
+			if err == nil {
+				err = src.Close()
 			}
 		}
+		if err != nil {
+			p.conn.WriteLine("CSTA 150 %v", NewParameterValue(err.Error()))
+			d.returnChunk(chunk)
+			p.drop()
+			p.EndSession(sessionId)
+			return
+		}
 		p.EndSession(sessionId)
+		duration := time.Since(startOfTransfer)
+
+		verified, err := d.verifyChunk(start, buf)
+		if err != nil {
+			d.log.Printf("dropping %s: %s", p.Nick, err)
+			d.returnChunk(chunk)
+			return
+		}
 
-		n, err := d.file.WriteAt(buf, int64(start))
-		size = uint64(n)
+		_, err = d.output.WriteAt(buf, int64(start))
 		if err != nil {
+			d.log.Println(err)
+			d.returnChunk(chunk)
 			return
 		}
+		d.chunkDone(chunk, verified, p.Nick, float64(size)/duration.Seconds())
 
 		// a logarithmic increase seems like a good idea,
 		// we want peers on a LAN to blow away the others
-		duration := time.Since(startOfTransfer)
-		if duration < time.Minute {
+		if duration < time.Minute && requestSize*2 <= maxChunkSize {
 			requestSize *= 2
-		} else if duration > time.Minute*4 {
+		} else if duration > time.Minute*4 && requestSize/2 >= minSize {
 			requestSize /= 2
 		}
 	}
@@ -0,0 +1,258 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"compress/bzip2"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// FileList is an ADC file listing, as found in files.xml.bz2
+// or returned by a partial list request.
+type FileList struct {
+	XMLName   xml.Name `xml:"FileListing"`
+	Version   string   `xml:"Version,attr"`
+	CID       string   `xml:"CID,attr"`
+	Base      string   `xml:"Base,attr"`
+	Generator string   `xml:"Generator,attr"`
+	FileListDir
+}
+
+// FileListDir is a directory within a FileList. A directory
+// marked Incomplete has contents that were not included in
+// a partial list.
+type FileListDir struct {
+	Name       string          `xml:"Name,attr,omitempty"`
+	Incomplete Flag            `xml:"Incomplete,attr"`
+	Dirs       []*FileListDir  `xml:"Directory"`
+	Files      []*FileListFile `xml:"File"`
+}
+
+// FileListFile is a file within a FileList.
+type FileListFile struct {
+	Name string `xml:"Name,attr"`
+	Size uint64 `xml:"Size,attr"`
+	TTH  string `xml:"TTH,attr"`
+	TS   int64  `xml:"TS,attr,omitempty"`
+}
+
+// Flag is a boolean attribute of a file list, written as "1".
+type Flag bool
+
+func (f Flag) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	if !f {
+		return xml.Attr{}, nil
+	}
+	return xml.Attr{Name: name, Value: "1"}, nil
+}
+
+func (f *Flag) UnmarshalXMLAttr(attr xml.Attr) error {
+	*f = Flag(attr.Value == "1" || attr.Value == "true")
+	return nil
+}
+
+// ParseFileList parses an uncompressed XML file list.
+func ParseFileList(r io.Reader) (*FileList, error) {
+	l := new(FileList)
+	err := xml.NewDecoder(r).Decode(l)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Lookup returns the directory at a path relative to the
+// base of the list, such as "/music/ogg/", or nil.
+func (l *FileList) Lookup(path string) *FileListDir {
+	if !strings.HasPrefix(path, l.Base) {
+		return nil
+	}
+	d := &l.FileListDir
+	for _, name := range strings.Split(path[len(l.Base):], "/") {
+		if name == "" {
+			continue
+		}
+		d = d.Dir(name)
+		if d == nil {
+			return nil
+		}
+	}
+	return d
+}
+
+// Dir returns the subdirectory with a given name, or nil.
+func (d *FileListDir) Dir(name string) *FileListDir {
+	for _, sub := range d.Dirs {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for each file beneath d, with the path of the
+// file relative to d, using "/" as a separator.
+func (d *FileListDir) Walk(fn func(path string, f *FileListFile) error) error {
+	return d.walk("", fn)
+}
+
+func (d *FileListDir) walk(prefix string, fn func(string, *FileListFile) error) error {
+	for _, f := range d.Files {
+		if err := fn(prefix+f.Name, f); err != nil {
+			return err
+		}
+	}
+	for _, sub := range d.Dirs {
+		if err := sub.walk(prefix+sub.Name+"/", fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetFileList fetches and parses the complete file list of the Peer,
+// falling back to a recursive partial list if files.xml.bz2 is refused.
+func (p *Peer) GetFileList(ctx context.Context) (*FileList, error) {
+	var l *FileList
+	err := p.withSession(ctx, func() error {
+		r, err := p.get("file", "files.xml.bz2")
+		if err != nil {
+			return err
+		}
+		l, err = ParseFileList(bzip2.NewReader(r))
+		if err != nil {
+			return err
+		}
+		// drain whatever the parser left behind
+		if _, err = io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+		return r.Close()
+	})
+	if _, ok := err.(*Status); ok {
+		return p.GetPartialFileList(ctx, "/", true)
+	}
+	return l, err
+}
+
+// GetPartialFileList fetches the listing of a directory on the Peer,
+// such as "/music/". Unless recursive is set, subdirectories
+// in the list will be marked Incomplete.
+func (p *Peer) GetPartialFileList(ctx context.Context, dir string, recursive bool) (*FileList, error) {
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	var flags []string
+	if recursive {
+		flags = append(flags, "RE1")
+	}
+	var l *FileList
+	err := p.withSession(ctx, func() error {
+		r, err := p.get("list", dir, flags...)
+		if err != nil {
+			return err
+		}
+		l, err = ParseFileList(r)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+		return r.Close()
+	})
+	return l, err
+}
+
+// withSession runs f within a session of its own, aborting any
+// I/O on the connection when ctx is done. The connection is
+// dropped if f fails, it may be left in the middle of a transfer.
+func (p *Peer) withSession(ctx context.Context, f func() error) error {
+	id := p.NextSessionId()
+	err := p.StartSession(id)
+	if err != nil {
+		p.EndSession(id)
+		return err
+	}
+	defer p.EndSession(id)
+
+	nc, _ := p.conn.conn.(net.Conn)
+	if nc != nil {
+		stop := make(chan bool)
+		done := make(chan bool)
+		if t, ok := ctx.Deadline(); ok {
+			nc.SetDeadline(t)
+		}
+		go func() {
+			select {
+			case <-ctx.Done():
+				nc.SetDeadline(time.Now())
+			case <-stop:
+			}
+			close(done)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+			nc.SetDeadline(time.Time{})
+		}()
+	}
+
+	err = f()
+	if err != nil {
+		if _, ok := err.(*Status); !ok {
+			p.drop()
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// get requests the whole of an item from the Peer and returns a
+// reader for the data that follows. A Status is returned if the
+// Peer refuses the request.
+func (p *Peer) get(typ, identifier string, flags ...string) (io.ReadCloser, error) {
+	f := "CGET %s %v 0 -1"
+	if len(flags) > 0 {
+		f += " " + strings.Join(flags, " ")
+	}
+	err := p.conn.WriteLine(f, typ, NewParameterValue(identifier))
+	if err != nil {
+		return nil, err
+	}
+	msg, err := p.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	switch msg.Cmd {
+	case "STA":
+		return nil, NewStatus(msg)
+	case "SND":
+	default:
+		return nil, Error("unhandled message: " + msg.String())
+	}
+	if len(msg.Params) < 4 || msg.Params[0] != typ || msg.Params[2] != "0" {
+		p.conn.WriteLine("CSTA 140 Invalid\\sarguments.")
+		return nil, Error("received invalid SND " + msg.String())
+	}
+	var size uint64
+	_, err = fmt.Sscan(msg.Params[3], &size)
+	if err != nil {
+		return nil, err
+	}
+	var rest []string
+	for _, flag := range msg.Params[4:] {
+		if strings.HasPrefix(flag, "ZL") {
+			rest = append(rest, flag)
+		}
+	}
+	return p.dataReader(rest, size)
+}
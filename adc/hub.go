@@ -12,6 +12,8 @@ import (
 	"net"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 // States
@@ -33,12 +35,19 @@ type Hub struct {
 	features          map[string]bool
 	info              map[string]*ParameterValue
 	log               *log.Logger
+	peersMu           sync.Mutex // guards peers and the peer rates
 	peers             map[string]*Peer
 	messages          chan *Message
 	searchRequestChan chan *SearchRequest
 	searchResultChans map[string](chan *SearchResult)
 	rcmChans          map[string](chan uint16)
 	handlers          map[string]func(*Message)
+	peerDownloadRate  uint64
+	peerUploadRate    uint64
+	shareMu           sync.Mutex // guards share and uploadSlots
+	share             *Share
+	uploadSlots       chan bool
+	readErr           error
 }
 
 type HubError struct {
@@ -116,7 +125,10 @@ func NewHub(pid *Identifier, url *url.URL, logger *log.Logger) (h *Hub, err erro
 		for {
 			msg, err := h.conn.ReadMessage()
 			if err != nil {
-				h.log.Fatal("error parsing reply: ", err)
+				// one hub going away should not take the others with it
+				h.readErr = err
+				close(h.messages)
+				return
 			}
 			h.messages <- msg
 		}
@@ -126,7 +138,10 @@ func NewHub(pid *Identifier, url *url.URL, logger *log.Logger) (h *Hub, err erro
 	h.conn.WriteLine("HSUP ADBASE ADTIGR")
 
 	// Get SUP from hub
-	msg := <-h.messages
+	msg, ok := <-h.messages
+	if !ok {
+		return nil, h.readErr
+	}
 
 	if msg.Cmd != "SUP" {
 		s := "did not recieve SUP: "
@@ -141,7 +156,7 @@ func NewHub(pid *Identifier, url *url.URL, logger *log.Logger) (h *Hub, err erro
 		case "AD":
 			h.features[word[2:]] = true
 		default:
-			h.log.Println("Error, unknown word %s in SUP", word)
+			h.log.Printf("Error, unknown word %s in SUP", word)
 		}
 	}
 
@@ -154,7 +169,10 @@ func NewHub(pid *Identifier, url *url.URL, logger *log.Logger) (h *Hub, err erro
 	}
 
 	// Get SID from hub
-	msg = <-h.messages
+	msg, ok = <-h.messages
+	if !ok {
+		return nil, h.readErr
+	}
 	if msg.Cmd != "SID" {
 		h.conn.Close()
 		return nil, Error("did not receive SID assignment from hub")
@@ -173,7 +191,10 @@ func NewHub(pid *Identifier, url *url.URL, logger *log.Logger) (h *Hub, err erro
 		h.sid, h.cid, h.pid, NewParameterValue(nick))
 
 	for {
-		msg := <-h.messages
+		msg, ok := <-h.messages
+		if !ok {
+			return nil, h.readErr
+		}
 		switch msg.Cmd {
 
 		case "GPA":
@@ -199,9 +220,7 @@ func NewHub(pid *Identifier, url *url.URL, logger *log.Logger) (h *Hub, err erro
 				go h.runLoop()
 				return h, nil
 			}
-			p := h.newPeer(sid)
-			h.peers[sid] = p
-			updatePeer(p, msg)
+			h.updatePeer(sid, msg)
 
 		case "STA":
 			code, _ := fmt.Sscan("%d", msg.Params[0])
@@ -222,7 +241,7 @@ func NewHub(pid *Identifier, url *url.URL, logger *log.Logger) (h *Hub, err erro
 			return nil, Error(fmt.Sprintf("kicked by hub: \"%s\"", NewParameterValue(reason)))
 
 		case "MSG":
-			h.log.Println("<hub> %s\n", NewParameterValue(msg.Params[0]))
+			h.log.Printf("<hub> %s\n", NewParameterValue(msg.Params[0]))
 
 		default:
 			s := "unknown message recieved before INF list : " + msg.Cmd
@@ -235,8 +254,19 @@ func NewHub(pid *Identifier, url *url.URL, logger *log.Logger) (h *Hub, err erro
 	return h, nil
 }
 
+// ErrNoPing is returned by Ping for a hub that does not
+// support the PING extension, though it could be reached.
+var ErrNoPing = Error("hub does not support PING")
+
 func Ping(url *url.URL) (info map[string]*ParameterValue, err error) {
+	return PingTimeout(url, 0)
+}
+
+// PingTimeout is Ping, failing if the hub has not answered
+// within timeout. A zero timeout waits for as long as it takes.
+func PingTimeout(url *url.URL, timeout time.Duration) (info map[string]*ParameterValue, err error) {
 	var conn *Conn
+	dialer := &net.Dialer{Timeout: timeout}
 	var digest hash.Hash
 	var keyPrint []byte
 	q := url.Query()
@@ -260,17 +290,23 @@ func Ping(url *url.URL) (info map[string]*ParameterValue, err error) {
 		if digest != nil {
 			return nil, Error("KEYP specified but adcs:// was not")
 		}
-		c, err := net.Dial("tcp", url.Host)
+		c, err := dialer.Dial("tcp", url.Host)
 		if err != nil {
 			return nil, err
 		}
+		if timeout > 0 {
+			c.SetDeadline(time.Now().Add(timeout))
+		}
 		conn = NewConn(c)
 
 	case "adcs":
-		c, err := tls.Dial("tcp", url.Host, &tls.Config{InsecureSkipVerify: true})
+		c, err := tls.DialWithDialer(dialer, "tcp", url.Host, &tls.Config{InsecureSkipVerify: true})
 		if err != nil {
 			return nil, err
 		}
+		if timeout > 0 {
+			c.SetDeadline(time.Now().Add(timeout))
+		}
 		if digest != nil {
 			digest.Write(c.ConnectionState().PeerCertificates[0].Raw)
 			if !bytes.Equal(digest.Sum(nil), keyPrint) {
@@ -304,7 +340,7 @@ func Ping(url *url.URL) (info map[string]*ParameterValue, err error) {
 		}
 	}
 	if !features["PING"] {
-		return nil, Error("hub does not support PING")
+		return nil, ErrNoPing
 	}
 	for {
 		msg, err := conn.ReadMessage()
@@ -332,7 +368,11 @@ func (h *Hub) RegisterMessageHandler(c string, f func(*Message)) {
 func (h *Hub) runLoop() {
 	for {
 		select {
-		case msg := <-h.messages:
+		case msg, ok := <-h.messages:
+			if !ok {
+				h.log.Printf("disconnected from %s: %s", h.url.Host, h.readErr)
+				return
+			}
 
 			f, ok := h.handlers[msg.Cmd]
 			if ok {
@@ -341,20 +381,14 @@ func (h *Hub) runLoop() {
 
 			switch msg.Cmd {
 			case "INF":
-				peerSid := msg.Params[0]
-				p := h.peers[peerSid]
-				if p == nil {
-					p = h.newPeer(peerSid)
-					h.peers[peerSid] = p
-				}
-				updatePeer(p, msg)
+				h.updatePeer(msg.Params[0], msg)
 
 			case "MSG":
 				switch len(msg.Params) {
 				case 1:
 					h.log.Printf("<hub> %s\n", NewParameterValue(msg.Params[0]))
 				case 2:
-					p := h.peers[msg.Params[0]]
+					p := h.peer(msg.Params[0])
 					h.log.Printf("<%s> %s\n", p.Nick, NewParameterValue(msg.Params[1]))
 				}
 
@@ -367,8 +401,8 @@ func (h *Hub) runLoop() {
 					h.log.Println("the second SID in a DRES message did not match our own")
 					continue
 				}
-				result := new(SearchResult)
-				result.peer = h.peers[msg.Params[0]]
+				result := &SearchResult{slots: -1}
+				result.peer = h.peer(msg.Params[0])
 
 				var results chan *SearchResult
 				ok := false
@@ -384,11 +418,17 @@ func (h *Hub) runLoop() {
 						}
 
 					case "SL":
-						n, err := fmt.Sscan(param[2:], &result.peer.Slots)
+						n, err := fmt.Sscan(param[2:], &result.slots)
 						if err != nil || n != 1 {
 							h.log.Fatalln("error parsing RES SL:", err)
 						}
 
+					case "TR":
+						tth, err := NewTigerTreeHash(param[2:])
+						if err == nil {
+							result.tth = tth
+						}
+
 					case "TO":
 						results, ok = h.searchResultChans[param[2:]]
 					}
@@ -401,8 +441,10 @@ func (h *Hub) runLoop() {
 
 			case "QUI":
 				sid := msg.Params[0]
+				h.peersMu.Lock()
 				h.log.Println("-", h.peers[sid].Nick, "has quit -")
 				delete(h.peers, sid)
+				h.peersMu.Unlock()
 
 			case "STA":
 				// TODO handle STA better
@@ -429,6 +471,10 @@ func (h *Hub) runLoop() {
 					}
 					//delete(h.rcmChans, t)
 					//TODO close the channel
+				} else if p := h.peer(msg.Params[0]); p != nil {
+					if share, _ := h.sharing(); share != nil {
+						go h.upload(p, msg.Params[3], token)
+					}
 				}
 
 			default:
@@ -437,7 +483,7 @@ func (h *Hub) runLoop() {
 
 		case r := <-h.searchRequestChan:
 			h.searchResultChans[r.token] = r.results
-			h.conn.WriteLine("BSCH %s TO%s %s TY1", h.sid, r.token, r.Terms)
+			h.conn.WriteLine("BSCH %s TO%s %s TY%d", h.sid, r.token, r.Terms, r.typ)
 		}
 	}
 }
@@ -452,18 +498,65 @@ func updatePeer(p *Peer, msg *Message) {
 		case "I6":
 			p.I6 = field[2:]
 		case "SL":
-			fmt.Sscan(field[2:], p.Slots)
+			fmt.Sscan(field[2:], &p.Slots)
 		case "NI":
 			p.Nick = NewParameterValue(field[2:]).String()
 		}
 	}
 }
 
+// updatePeer applies an INF to the Peer with sid,
+// adding the Peer if it is new.
+func (h *Hub) updatePeer(sid string, msg *Message) {
+	h.peersMu.Lock()
+	defer h.peersMu.Unlock()
+	p := h.peers[sid]
+	if p == nil {
+		p = h.newPeer(sid)
+		h.peers[sid] = p
+	}
+	updatePeer(p, msg)
+}
+
+func (h *Hub) peer(sid string) *Peer {
+	h.peersMu.Lock()
+	defer h.peersMu.Unlock()
+	return h.peers[sid]
+}
+
+// newPeer must be called with peersMu held.
 func (h *Hub) newPeer(sid string) *Peer {
 	return &Peer{
-		hub: h,
-		SID: sid,
+		hub:           h,
+		SID:           sid,
+		DownloadLimit: NewRateLimiter(h.peerDownloadRate),
+		UploadLimit:   NewRateLimiter(h.peerUploadRate),
+	}
+}
+
+// SetPeerRateLimits sets the download and upload limits in bytes
+// per second for each Peer on the hub, zero for no limit.
+func (h *Hub) SetPeerRateLimits(download, upload uint64) {
+	h.peersMu.Lock()
+	defer h.peersMu.Unlock()
+	h.peerDownloadRate = download
+	h.peerUploadRate = upload
+	for _, p := range h.peers {
+		p.DownloadLimit.SetRate(download)
+		p.UploadLimit.SetRate(upload)
+	}
+}
+
+// FindPeer returns the Peer with a given nick or CID, or nil.
+func (h *Hub) FindPeer(s string) *Peer {
+	h.peersMu.Lock()
+	defer h.peersMu.Unlock()
+	for _, p := range h.peers {
+		if p.Nick == s || p.CID == s {
+			return p
+		}
 	}
+	return nil
 }
 
 // ReverseConnectToMe sends a RCM message to a Peer with token string.
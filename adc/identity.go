@@ -0,0 +1,82 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the size of a generated PID, that of a Tiger digest
+const pidSize = tigerSize
+
+// An Identity holds the private ID a client presents to hubs. It
+// should be generated once and kept, hubs derive the client ID
+// from it and others may use that to recognise the client.
+type Identity struct {
+	PID *Identifier
+}
+
+// NewIdentity returns an Identity with a random PID.
+func NewIdentity() (*Identity, error) {
+	b := make([]byte, pidSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{NewPrivateID(b)}, nil
+}
+
+// LoadIdentity reads an Identity saved with Save.
+func LoadIdentity(path string) (*Identity, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := strings.TrimSpace(string(b))
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != pidSize {
+		return nil, Error("bad PID in " + path)
+	}
+	return &Identity{NewPrivateID(raw)}, nil
+}
+
+// Save writes the Identity to path, readable only by the user.
+func (id *Identity) Save(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(id.PID.String()+"\n"), 0600)
+}
+
+// LoadOrCreateIdentity loads the Identity at path, generating
+// and saving a new one if there is none.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	id, err := LoadIdentity(path)
+	if err == nil || !os.IsNotExist(err) {
+		return id, err
+	}
+	id, err = NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return id, id.Save(path)
+}
+
+// ConfigDir returns the directory for go-adc configuration,
+// such as ~/.config/go-adc.
+func ConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "go-adc"), nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// Global limits applied to every transfer, in addition
+// to any limits set on an individual Peer.
+var (
+	DownloadLimit = new(RateLimiter)
+	UploadLimit   = new(RateLimiter)
+)
+
+// the largest slice passed through a limiter in one go,
+// keeps slow limits from bursting a whole buffer at once
+const limitChunk = 16384
+
+// A RateLimiter is a token bucket that limits throughput to
+// a number of bytes per second. The bucket holds at most one
+// second worth of tokens. A zero rate imposes no limit, and
+// the rate may be changed at any time.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter passing rate bytes per second.
+func NewRateLimiter(rate uint64) *RateLimiter {
+	l := new(RateLimiter)
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the limit to rate bytes per second, zero for no limit.
+func (l *RateLimiter) SetRate(rate uint64) {
+	l.mu.Lock()
+	l.rate = float64(rate)
+	l.tokens = l.rate
+	l.last = time.Now()
+	l.mu.Unlock()
+}
+
+// Rate returns the current limit in bytes per second.
+func (l *RateLimiter) Rate() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return uint64(l.rate)
+}
+
+// Wait blocks until n bytes may pass the limiter.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+func waitAll(limiters []*RateLimiter, n int) {
+	for _, l := range limiters {
+		l.Wait(n)
+	}
+}
+
+// limitedReader throttles reads from a bufio.Reader. It also
+// implements io.ByteReader so decompressors may use it without
+// buffering past the end of their stream.
+type limitedReader struct {
+	r        *bufio.Reader
+	limiters []*RateLimiter
+	pending  int
+}
+
+func newLimitedReader(r *bufio.Reader, limiters ...*RateLimiter) *limitedReader {
+	return &limitedReader{r: r, limiters: limiters}
+}
+
+func (r *limitedReader) Read(b []byte) (n int, err error) {
+	if len(b) > limitChunk {
+		b = b[:limitChunk]
+	}
+	n, err = r.r.Read(b)
+	waitAll(r.limiters, n)
+	return
+}
+
+func (r *limitedReader) ReadByte() (c byte, err error) {
+	c, err = r.r.ReadByte()
+	if err == nil {
+		// waiting on every byte would be far too slow
+		r.pending++
+		if r.pending == 4096 {
+			waitAll(r.limiters, r.pending)
+			r.pending = 0
+		}
+	}
+	return
+}
+
+// limitedWriter throttles writes to an io.Writer.
+type limitedWriter struct {
+	w        io.Writer
+	limiters []*RateLimiter
+}
+
+func newLimitedWriter(w io.Writer, limiters ...*RateLimiter) *limitedWriter {
+	return &limitedWriter{w: w, limiters: limiters}
+}
+
+func (w *limitedWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		p := b
+		if len(p) > limitChunk {
+			p = p[:limitChunk]
+		}
+		waitAll(w.limiters, len(p))
+		m, err := w.w.Write(p)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return n, nil
+}
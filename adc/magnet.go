@@ -0,0 +1,239 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"encoding/base32"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Magnet is a magnet link describing a single file.
+type Magnet struct {
+	TTH               *TigerTreeHash // xt=urn:tree:tiger: or the TTH half of urn:bitprint:
+	SHA1              []byte         // the SHA1 half of xt=urn:bitprint:, or xt=urn:sha1:
+	Topics            []string       // other xt values, kept as they are
+	DisplayName       string         // dn
+	Size              uint64         // xl, zero if unknown
+	ExactSources      []string       // xs
+	AcceptableSources []string       // as
+	WebSources        []string       // ws
+	Keywords          []string       // kt
+}
+
+const (
+	tigerURN    = "urn:tree:tiger:"
+	bitprintURN = "urn:bitprint:"
+	sha1URN     = "urn:sha1:"
+)
+
+// ParseMagnet parses a magnet link, returning the first file
+// if the link describes several with indexed parameters.
+func ParseMagnet(s string) (*Magnet, error) {
+	ms, err := ParseMagnets(s)
+	if err != nil {
+		return nil, err
+	}
+	return ms[0], nil
+}
+
+// ParseMagnets parses a magnet link that may describe several
+// files through indexed parameters such as xt.1 and dn.1. Plain
+// parameters, and indexed ones without an xt of their own,
+// belong to the first file returned.
+func ParseMagnets(s string) ([]*Magnet, error) {
+	if !strings.HasPrefix(s, "magnet:?") {
+		return nil, Error("not a magnet link: " + s)
+	}
+	values, err := url.ParseQuery(s[8:])
+	if err != nil {
+		return nil, err
+	}
+
+	byIndex := make(map[int]*Magnet)
+	var indices []int
+	for key, vs := range values {
+		index := -1
+		if i := strings.IndexByte(key, '.'); i != -1 {
+			index, err = strconv.Atoi(key[i+1:])
+			if err != nil || index < 0 {
+				return nil, Error("bad magnet parameter " + key)
+			}
+			key = key[:i]
+		}
+		m, ok := byIndex[index]
+		if !ok {
+			m = new(Magnet)
+			byIndex[index] = m
+			indices = append(indices, index)
+		}
+		for _, v := range vs {
+			if err := m.set(key, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(indices) == 0 {
+		return nil, Error("empty magnet link")
+	}
+	sort.Ints(indices)
+
+	// an index without a topic, as in xs.2, only numbers another
+	// parameter of the first file rather than starting a new one
+	var ms, extra []*Magnet
+	for _, index := range indices {
+		m := byIndex[index]
+		if m.TTH == nil && m.SHA1 == nil && len(m.Topics) == 0 {
+			extra = append(extra, m)
+		} else {
+			ms = append(ms, m)
+		}
+	}
+	if len(ms) == 0 {
+		ms, extra = extra[:1], extra[1:]
+	}
+	for _, m := range extra {
+		ms[0].merge(m)
+	}
+	return ms, nil
+}
+
+func (m *Magnet) merge(o *Magnet) {
+	if m.DisplayName == "" {
+		m.DisplayName = o.DisplayName
+	}
+	if m.Size == 0 {
+		m.Size = o.Size
+	}
+	m.ExactSources = append(m.ExactSources, o.ExactSources...)
+	m.AcceptableSources = append(m.AcceptableSources, o.AcceptableSources...)
+	m.WebSources = append(m.WebSources, o.WebSources...)
+	m.Keywords = append(m.Keywords, o.Keywords...)
+}
+
+func (m *Magnet) set(key, v string) (err error) {
+	switch key {
+	case "xt":
+		return m.setTopic(v)
+	case "dn":
+		m.DisplayName = v
+	case "xl":
+		m.Size, err = strconv.ParseUint(v, 10, 64)
+	case "xs":
+		m.ExactSources = append(m.ExactSources, v)
+	case "as":
+		m.AcceptableSources = append(m.AcceptableSources, v)
+	case "ws":
+		m.WebSources = append(m.WebSources, v)
+	case "kt":
+		m.Keywords = append(m.Keywords, strings.Fields(v)...)
+	}
+	return
+}
+
+func (m *Magnet) setTopic(v string) (err error) {
+	switch {
+	case strings.HasPrefix(v, tigerURN):
+		m.TTH, err = parseTTH(v[len(tigerURN):])
+
+	case strings.HasPrefix(v, bitprintURN):
+		parts := strings.Split(v[len(bitprintURN):], ".")
+		if len(parts) != 2 {
+			return Error("bad bitprint " + v)
+		}
+		if m.SHA1, err = parseSHA1(parts[0]); err != nil {
+			return err
+		}
+		m.TTH, err = parseTTH(parts[1])
+
+	case strings.HasPrefix(v, sha1URN):
+		m.SHA1, err = parseSHA1(v[len(sha1URN):])
+
+	default:
+		m.Topics = append(m.Topics, v)
+	}
+	return
+}
+
+func parseTTH(s string) (*TigerTreeHash, error) {
+	if len(s) != 39 {
+		return nil, Error("bad Tiger tree hash " + s)
+	}
+	return NewTigerTreeHash(s)
+}
+
+func parseSHA1(s string) ([]byte, error) {
+	if len(s) != 32 {
+		return nil, Error("bad SHA1 hash " + s)
+	}
+	return base32.StdEncoding.DecodeString(s)
+}
+
+// the characters that would break a source URL out of its parameter
+var sourceEscaper = strings.NewReplacer(
+	"%", "%25",
+	"&", "%26",
+	"#", "%23",
+	"+", "%2B",
+	" ", "%20")
+
+// String formats the magnet link with dn, xl and xt first,
+// in the order adc-magnetize has always used.
+func (m *Magnet) String() string {
+	return "magnet:?" + strings.Join(m.params(""), "&")
+}
+
+// FormatMagnets formats a magnet link describing several files,
+// numbering the parameters of each as in xt.1 and dn.1. It is
+// the reverse of ParseMagnets.
+func FormatMagnets(ms []*Magnet) string {
+	if len(ms) == 1 {
+		return ms[0].String()
+	}
+	var params []string
+	for i, m := range ms {
+		params = append(params, m.params(fmt.Sprintf(".%d", i+1))...)
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// params returns the parameters of m, with index after each key.
+func (m *Magnet) params(index string) []string {
+	var params []string
+	add := func(key, value string) {
+		params = append(params, key+index+"="+value)
+	}
+	if m.DisplayName != "" {
+		add("dn", url.QueryEscape(m.DisplayName))
+	}
+	if m.Size != 0 {
+		add("xl", strconv.FormatUint(m.Size, 10))
+	}
+	switch {
+	case m.TTH != nil && m.SHA1 != nil:
+		add("xt", bitprintURN+Base32EncodeString(m.SHA1)+"."+m.TTH.String())
+	case m.TTH != nil:
+		add("xt", tigerURN+m.TTH.String())
+	case m.SHA1 != nil:
+		add("xt", sha1URN+Base32EncodeString(m.SHA1))
+	}
+	for _, t := range m.Topics {
+		add("xt", t)
+	}
+	for _, s := range m.ExactSources {
+		add("xs", sourceEscaper.Replace(s))
+	}
+	for _, s := range m.AcceptableSources {
+		add("as", sourceEscaper.Replace(s))
+	}
+	for _, s := range m.WebSources {
+		add("ws", sourceEscaper.Replace(s))
+	}
+	if len(m.Keywords) > 0 {
+		add("kt", url.QueryEscape(strings.Join(m.Keywords, " ")))
+	}
+	return params
+}
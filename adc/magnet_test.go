@@ -0,0 +1,105 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	testTTH  = "LWPNACQDBZRYXW3VHJVCJ64QBZNGHOHHHZWCLNQ"
+	testTTH2 = "QHDLHFE2HSKAVRL4FHEJBLIPHEMAZQA5ZMQXY7A"
+	testSHA1 = "FBSTJF5BBTXX5WRTQ7HHDFPBBXYT5ZNJ"
+)
+
+func mustTTH(t *testing.T, s string) *TigerTreeHash {
+	tth, err := NewTigerTreeHash(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tth
+}
+
+func TestMagnetRoundTrip(t *testing.T) {
+	sha1, err := parseSHA1(testSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*Magnet{
+		{TTH: mustTTH(t, testTTH), DisplayName: "a file & more.txt", Size: 1234},
+		{TTH: mustTTH(t, testTTH), SHA1: sha1, DisplayName: "bitprint"},
+		{SHA1: sha1, Topics: []string{"urn:btih:abcdef"}},
+		{
+			TTH:               mustTTH(t, testTTH),
+			ExactSources:      []string{"adc://hub.example.com:1511", "adcs://other.example.com:1511/?kp=SHA256/ABC"},
+			AcceptableSources: []string{"http://a.example.com/f?x=1&y=2", "http://b.example.com/f#frag"},
+			WebSources:        []string{"http://c.example.com/a b"},
+			Keywords:          []string{"one", "two", "three"},
+		},
+	} {
+		s := m.String()
+		got, err := ParseMagnet(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("%s\nparsed as %+v\nwanted    %+v", s, got, m)
+		}
+	}
+}
+
+func TestMagnetBitprint(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:bitprint:" + testSHA1 + "." + testTTH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TTH == nil || m.TTH.String() != testTTH {
+		t.Errorf("TTH of bitprint is %v", m.TTH)
+	}
+	if Base32EncodeString(m.SHA1) != testSHA1 {
+		t.Errorf("SHA1 of bitprint is %s", Base32EncodeString(m.SHA1))
+	}
+	if _, err = ParseMagnet("magnet:?xt=urn:bitprint:" + testSHA1); err == nil {
+		t.Error("a bitprint without a TTH was accepted")
+	}
+}
+
+func TestMagnetIndexed(t *testing.T) {
+	s := "magnet:?xt.1=urn:tree:tiger:" + testTTH + "&dn.1=one&xl.1=10" +
+		"&xt.2=urn:tree:tiger:" + testTTH2 + "&dn.2=two" +
+		"&xs.3=adc://hub.example.com:1511&kt=word"
+	ms, err := ParseMagnets(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Magnet{
+		{
+			TTH:          mustTTH(t, testTTH),
+			DisplayName:  "one",
+			Size:         10,
+			ExactSources: []string{"adc://hub.example.com:1511"},
+			Keywords:     []string{"word"},
+		},
+		{TTH: mustTTH(t, testTTH2), DisplayName: "two"},
+	}
+	if !reflect.DeepEqual(ms, want) {
+		t.Fatalf("parsed as %+v %+v", ms[0], ms[1])
+	}
+
+	s = FormatMagnets(ms)
+	got, err := ParseMagnets(s)
+	if err != nil {
+		t.Fatalf("%s: %s", s, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s did not survive a round trip", s)
+	}
+}
+
+func TestMagnetSingleIndexed(t *testing.T) {
+	m := &Magnet{TTH: mustTTH(t, testTTH), DisplayName: "only"}
+	if s := FormatMagnets([]*Magnet{m}); s != m.String() {
+		t.Errorf("a single file was formatted as %s", s)
+	}
+}
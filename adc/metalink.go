@@ -0,0 +1,223 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A Metalink lists files along with their hashes and the
+// places they may be fetched from, as described by RFC 5854.
+// Version 3 files, from before the RFC, are read as well.
+type Metalink struct {
+	Files []*MetalinkFile
+}
+
+// A MetalinkFile is a single file of a Metalink.
+type MetalinkFile struct {
+	Name   string            // may contain directories, separated by '/'
+	Size   uint64            // zero if unknown
+	TTH    *TigerTreeHash    // from a tiger tree hash or a magnet link
+	Hashes map[string][]byte // other hashes by their IANA name, such as "sha-256"
+	Pieces []*MetalinkPieces
+	URLs   []string // most preferred first
+}
+
+// MetalinkPieces hashes each successive Length bytes of a file.
+type MetalinkPieces struct {
+	Type   string
+	Length uint64
+	Hashes [][]byte
+}
+
+// The elements of a version 4 file, and where they sat in version 3.
+type metalinkXML struct {
+	Files  []*metalinkFileXML `xml:"file"`
+	Files3 []*metalinkFileXML `xml:"files>file"`
+}
+
+type metalinkFileXML struct {
+	Name     string               `xml:"name,attr"`
+	Size     uint64               `xml:"size"`
+	Hashes   []*metalinkHashXML   `xml:"hash"`
+	Hashes3  []*metalinkHashXML   `xml:"verification>hash"`
+	Pieces   []*metalinkPiecesXML `xml:"pieces"`
+	Pieces3  []*metalinkPiecesXML `xml:"verification>pieces"`
+	URLs     []*metalinkURLXML    `xml:"url"`
+	URLs3    []*metalinkURLXML    `xml:"resources>url"`
+	MetaURLs []*metalinkURLXML    `xml:"metaurl"`
+}
+
+type metalinkHashXML struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPiecesXML struct {
+	Type   string             `xml:"type,attr"`
+	Length uint64             `xml:"length,attr"`
+	Hashes []*metalinkHashXML `xml:"hash"`
+}
+
+type metalinkURLXML struct {
+	Priority   int    `xml:"priority,attr"`   // version 4, lowest first
+	Preference int    `xml:"preference,attr"` // version 3, highest first
+	Type       string `xml:"type,attr"`       // version 3, such as "http" or "bittorrent"
+	Value      string `xml:",chardata"`
+}
+
+// the hash types taken as a Tiger tree hash
+var tigerTypes = map[string]bool{
+	"tiger-tree":     true,
+	"tree:tiger":     true,
+	"urn:tree:tiger": true,
+	"tth":            true,
+}
+
+var shaName = regexp.MustCompile(`^sha(\d+)$`)
+
+// hashName returns the IANA name for a hash type, version 3
+// files wrote sha1 and sha256 where version 4 has sha-1 and sha-256.
+func hashName(typ string) string {
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	return shaName.ReplaceAllString(typ, "sha-$1")
+}
+
+// ParseMetalink reads a Metalink file.
+func ParseMetalink(r io.Reader) (*Metalink, error) {
+	var x metalinkXML
+	if err := xml.NewDecoder(r).Decode(&x); err != nil {
+		return nil, err
+	}
+	ml := new(Metalink)
+	for _, fx := range append(x.Files, x.Files3...) {
+		f, err := fx.file()
+		if err != nil {
+			return nil, err
+		}
+		ml.Files = append(ml.Files, f)
+	}
+	if len(ml.Files) == 0 {
+		return nil, Error("no files in metalink")
+	}
+	return ml, nil
+}
+
+func (fx *metalinkFileXML) file() (*MetalinkFile, error) {
+	if fx.Name == "" {
+		return nil, Error("metalink file has no name")
+	}
+	f := &MetalinkFile{
+		Name:   fx.Name,
+		Size:   fx.Size,
+		Hashes: make(map[string][]byte),
+	}
+
+	for _, hx := range append(fx.Hashes, fx.Hashes3...) {
+		typ := hashName(hx.Type)
+		value := strings.TrimSpace(hx.Value)
+		if tigerTypes[typ] {
+			b, err := decodeHash(value, tigerSize)
+			if err != nil {
+				return nil, Error("bad tiger tree hash for " + f.Name)
+			}
+			f.TTH = NewTigerTreeHashFromBytes(b)
+			continue
+		}
+		b, err := decodeHash(value, 0)
+		if err != nil {
+			return nil, Error("bad " + typ + " hash for " + f.Name)
+		}
+		f.Hashes[typ] = b
+	}
+
+	for _, px := range append(fx.Pieces, fx.Pieces3...) {
+		if px.Length == 0 {
+			return nil, Error("metalink pieces of no length for " + f.Name)
+		}
+		p := &MetalinkPieces{Type: hashName(px.Type), Length: px.Length}
+		for _, hx := range px.Hashes {
+			b, err := decodeHash(strings.TrimSpace(hx.Value), 0)
+			if err != nil {
+				return nil, Error("bad " + p.Type + " piece hash for " + f.Name)
+			}
+			p.Hashes = append(p.Hashes, b)
+		}
+		f.Pieces = append(f.Pieces, p)
+	}
+
+	urls := append(fx.URLs, fx.URLs3...)
+	sort.SliceStable(urls, func(i, j int) bool { return urls[i].rank() < urls[j].rank() })
+	for _, ux := range urls {
+		u := strings.TrimSpace(ux.Value)
+		var err error
+		switch {
+		case strings.HasPrefix(u, "magnet:"):
+			err = f.addMagnet(u)
+		case strings.EqualFold(ux.Type, "bittorrent"):
+			// a .torrent rather than the file itself
+		default:
+			f.URLs = append(f.URLs, u)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// other metaurls are .torrent files and the like
+	for _, ux := range fx.MetaURLs {
+		if u := strings.TrimSpace(ux.Value); strings.HasPrefix(u, "magnet:") {
+			if err := f.addMagnet(u); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f, nil
+}
+
+// addMagnet takes the hash and hubs of a magnet link.
+func (f *MetalinkFile) addMagnet(u string) error {
+	m, err := ParseMagnet(u)
+	if err != nil {
+		return err
+	}
+	if f.TTH == nil {
+		f.TTH = m.TTH
+	}
+	f.URLs = append(f.URLs, m.ExactSources...)
+	f.URLs = append(f.URLs, m.AcceptableSources...)
+	return nil
+}
+
+// rank orders URLs, a version 4 priority runs from 1 up to
+// 999999 and a version 3 preference from 100 down to 0.
+func (ux *metalinkURLXML) rank() int {
+	switch {
+	case ux.Priority > 0:
+		return ux.Priority
+	case ux.Preference > 0:
+		return 101 - ux.Preference
+	}
+	return 1000000
+}
+
+// decodeHash reads a hash in hex or unpadded base32,
+// which must be size bytes long if size is not zero.
+func decodeHash(s string, size int) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		b, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(s))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size != 0 && len(b) != size {
+		return nil, Error("hash is the wrong size")
+	}
+	return b, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const metalink4 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="dir/example.ext">
+    <size>14471447</size>
+    <hash type="sha-256">f0ad929cd259957e160ea442eb80986b5f01f0ba2ffa2e6c0e4d8e9bf4dc9cab</hash>
+    <hash type="tiger-tree">` + testTTH + `</hash>
+    <pieces length="262144" type="sha-1">
+      <hash>a9993e364706816aba3e25717850c26c9cd0d89d</hash>
+      <hash>84983e441c3bd26ebaae4aa1f95129e5e54670f1</hash>
+    </pieces>
+    <url priority="3">http://c.example.com/example.ext</url>
+    <url priority="1">http://a.example.com/example.ext</url>
+    <url>http://d.example.com/example.ext</url>
+    <url priority="2">ftp://b.example.com/example.ext</url>
+    <metaurl mediatype="torrent">http://example.com/example.ext.torrent</metaurl>
+    <metaurl mediatype="magnet">magnet:?xt=urn:tree:tiger:` + testTTH + `&amp;xs=adc://hub.example.com:1511</metaurl>
+  </file>
+</metalink>`
+
+const metalink3 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="example.ext">
+      <size>1024</size>
+      <verification>
+        <hash type="SHA1">a9993e364706816aba3e25717850c26c9cd0d89d</hash>
+        <hash type="md5">900150983cd24fb0d6963f7d28e17f72</hash>
+        <pieces length="512" type="sha1">
+          <hash piece="0">a9993e364706816aba3e25717850c26c9cd0d89d</hash>
+          <hash piece="1">84983e441c3bd26ebaae4aa1f95129e5e54670f1</hash>
+        </pieces>
+      </verification>
+      <resources>
+        <url type="http" preference="10">http://low.example.com/example.ext</url>
+        <url type="bittorrent" preference="100">http://example.com/example.ext.torrent</url>
+        <url type="http" preference="90">http://high.example.com/example.ext</url>
+        <url type="ftp" preference="50">ftp://mid.example.com/example.ext</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseMetalink(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		xml  string
+		want *MetalinkFile
+	}{
+		{"version 4", metalink4, &MetalinkFile{
+			Name: "dir/example.ext",
+			Size: 14471447,
+			TTH:  mustTTH(t, testTTH),
+			Hashes: map[string][]byte{
+				"sha-256": mustHex(t, "f0ad929cd259957e160ea442eb80986b5f01f0ba2ffa2e6c0e4d8e9bf4dc9cab"),
+			},
+			Pieces: []*MetalinkPieces{{
+				Type:   "sha-1",
+				Length: 262144,
+				Hashes: [][]byte{
+					mustHex(t, "a9993e364706816aba3e25717850c26c9cd0d89d"),
+					mustHex(t, "84983e441c3bd26ebaae4aa1f95129e5e54670f1"),
+				},
+			}},
+			URLs: []string{
+				"http://a.example.com/example.ext",
+				"ftp://b.example.com/example.ext",
+				"http://c.example.com/example.ext",
+				"http://d.example.com/example.ext",
+				"adc://hub.example.com:1511",
+			},
+		}},
+		{"version 3", metalink3, &MetalinkFile{
+			Name: "example.ext",
+			Size: 1024,
+			Hashes: map[string][]byte{
+				"sha-1": mustHex(t, "a9993e364706816aba3e25717850c26c9cd0d89d"),
+				"md5":   mustHex(t, "900150983cd24fb0d6963f7d28e17f72"),
+			},
+			Pieces: []*MetalinkPieces{{
+				Type:   "sha-1",
+				Length: 512,
+				Hashes: [][]byte{
+					mustHex(t, "a9993e364706816aba3e25717850c26c9cd0d89d"),
+					mustHex(t, "84983e441c3bd26ebaae4aa1f95129e5e54670f1"),
+				},
+			}},
+			URLs: []string{
+				"http://high.example.com/example.ext",
+				"ftp://mid.example.com/example.ext",
+				"http://low.example.com/example.ext",
+			},
+		}},
+	} {
+		ml, err := ParseMetalink(strings.NewReader(test.xml))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(ml.Files) != 1 {
+			t.Errorf("%s: %d files", test.name, len(ml.Files))
+			continue
+		}
+		if got := ml.Files[0]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parsed as\n%+v\nwanted\n%+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHashName(t *testing.T) {
+	for typ, want := range map[string]string{
+		"sha1":    "sha-1",
+		"SHA256":  "sha-256",
+		"sha-512": "sha-512",
+		" md5 ":   "md5",
+		"sha3":    "sha-3",
+	} {
+		if got := hashName(typ); got != want {
+			t.Errorf("hashName(%q) is %q, not %q", typ, got, want)
+		}
+	}
+}
+
+func TestParseMetalinkErrors(t *testing.T) {
+	for name, xml := range map[string]string{
+		"no files":     `<metalink xmlns="urn:ietf:params:xml:ns:metalink"></metalink>`,
+		"no name":      `<metalink><file><size>1</size></file></metalink>`,
+		"bad hash":     `<metalink><file name="a"><hash type="sha-1">not a hash</hash></file></metalink>`,
+		"short tiger":  `<metalink><file name="a"><hash type="tiger-tree">abcd</hash></file></metalink>`,
+		"empty pieces": `<metalink><file name="a"><pieces type="sha-1" length="0"></pieces></file></metalink>`,
+		"bad piece":    `<metalink><file name="a"><pieces type="sha-1" length="1"><hash>!!</hash></pieces></file></metalink>`,
+	} {
+		if _, err := ParseMetalink(strings.NewReader(xml)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
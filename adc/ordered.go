@@ -0,0 +1,82 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"io"
+	"sync"
+)
+
+// An OrderedWriter turns the out of order writes of a download into
+// a stream. Data at the current offset is written through at once,
+// data further along is held until the gap before it is filled.
+// WriteAt never blocks, a DownloadDispatcher writing to one keeps
+// the data held in check by not fetching chunks that begin more
+// than window bytes past the current offset.
+type OrderedWriter struct {
+	w       io.Writer
+	window  int64
+	mu      sync.Mutex
+	next    int64
+	held    map[int64][]byte
+	heldLen int64
+	err     error
+}
+
+func NewOrderedWriter(w io.Writer, window int64) *OrderedWriter {
+	return &OrderedWriter{
+		w:      w,
+		window: window,
+		held:   make(map[int64][]byte),
+	}
+}
+
+func (o *OrderedWriter) WriteAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return 0, o.err
+	}
+	if off < o.next {
+		return 0, Error("write behind the stream")
+	}
+	if off > o.next {
+		b := make([]byte, len(p))
+		copy(b, p)
+		o.held[off] = b
+		o.heldLen += int64(len(b))
+		return len(p), nil
+	}
+
+	_, o.err = o.w.Write(p)
+	o.next += int64(len(p))
+	for o.err == nil {
+		b, ok := o.held[o.next]
+		if !ok {
+			break
+		}
+		delete(o.held, o.next)
+		o.heldLen -= int64(len(b))
+		_, o.err = o.w.Write(b)
+		o.next += int64(len(b))
+	}
+	if o.err != nil {
+		return 0, o.err
+	}
+	return len(p), nil
+}
+
+// ahead reports whether a chunk starting at off is
+// too far past the stream to be fetched yet.
+func (o *OrderedWriter) ahead(off int64) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return off-o.next > o.window
+}
+
+// Written returns the length of the stream written so far.
+func (o *OrderedWriter) Written() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.next
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"github.com/3M3RY/go-thex"
 	"github.com/3M3RY/go-tiger"
+	"io"
 	"net"
 	"sync"
 )
@@ -27,6 +28,11 @@ type Peer struct {
 	sessionMu   sync.Mutex
 	sessionId   uint
 	sessionWait map[uint]chan uint
+
+	// limits for transfers with this Peer alone,
+	// see also DownloadLimit and UploadLimit
+	DownloadLimit *RateLimiter
+	UploadLimit   *RateLimiter
 }
 
 // NextSession returns the next id for a communication session.
@@ -45,9 +51,6 @@ func (p *Peer) StartSession(id uint) (err error) {
 	if p.sessionId == id {
 		if p.conn == nil {
 			err = p.connect()
-			if err != nil {
-				return err
-			}
 			p.sessionMu.Unlock()
 			return err
 		} else {
@@ -168,6 +171,31 @@ func (p *Peer) connect() (err error) {
 	return nil
 }
 
+// dataReader returns a reader for the size bytes following a SND,
+// decompressing them if flags mark a ZL1 stream. Some peers will
+// compress data that was not requested compressed. Once the data
+// is read, Close must be called to check the end of the stream.
+func (p *Peer) dataReader(flags []string, size uint64) (io.ReadCloser, error) {
+	src := newLimitedReader(p.conn.R, DownloadLimit, p.DownloadLimit)
+	for _, flag := range flags {
+		switch flag {
+		case "ZL1":
+			return newZlibReader(src, size)
+		case "ZL0":
+		default:
+			return nil, Error("unknown SND flag " + flag)
+		}
+	}
+	return io.NopCloser(io.LimitReader(src, int64(size))), nil
+}
+
+// drop closes a connection that is out of step with the Peer,
+// the next session will make a new one.
+func (p *Peer) drop() {
+	p.conn.Close()
+	p.conn = nil
+}
+
 // Fetch and verify a row of leaves from Peer
 func (p *Peer) getTigerTreeHashLeaves(tth *TigerTreeHash) (leaves [][]byte, err error) {
 	if p.conn == nil {
@@ -187,37 +215,38 @@ func (p *Peer) getTigerTreeHashLeaves(tth *TigerTreeHash) (leaves [][]byte, err
 	case "SND":
 		if msg.Params[0] != "tthl" || msg.Params[1] != identifier || msg.Params[2] != "0" {
 			p.conn.WriteLine("CSTA 140 Invalid\\sarguments.")
-			p.conn.Close()
+			p.drop()
 			return nil, Error("received invalid SND" + msg.String())
 		}
 	default:
-		p.conn.Close()
+		p.drop()
 		return nil, Error("unhandled message: " + msg.String())
 	}
 
 	var tthSize int
 	_, err = fmt.Sscanf(msg.Params[3], "%d", &tthSize)
 	if err != nil {
-		p.conn.WriteLine("CSTA 140 Unable\\sto\\sparse\\ssize:\\s", NewParameterValue(err.Error()))
-		p.conn.Close()
+		p.conn.WriteLine("CSTA 140 Unable\\sto\\sparse\\ssize:\\s%v", NewParameterValue(err.Error()))
+		p.drop()
 		return nil, err
 	}
 	if tthSize < 24 { // hardcoded to the size of tiger
 		p.conn.WriteLine("CSTA 140 TTH\\sis\\stoo\\ssmall")
-		p.conn.Close()
+		p.drop()
 		return nil, Error(fmt.Sprintf("received a TTH SND with a size smaller than a single leaf"))
 	}
 
 	leafStream := make([]byte, tthSize)
-
-	var pos int
-	for pos < tthSize {
-		n, err := p.conn.R.Read(leafStream[pos:])
-		if err != nil {
-			p.conn.Close()
-			return nil, err
+	r, err := p.dataReader(msg.Params[4:], uint64(tthSize))
+	if err == nil {
+		_, err = io.ReadFull(r, leafStream)
+		if err == nil {
+			err = r.Close()
 		}
-		pos += n
+	}
+	if err != nil {
+		p.drop()
+		return nil, err
 	}
 
 	tree := thex.New(tiger.New())
@@ -0,0 +1,120 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakePeer returns a Peer connected to a goroutine that
+// answers the first line it reads with reply.
+func fakePeer(t *testing.T, reply []byte) *Peer {
+	a, b := net.Pipe()
+	go func() {
+		defer b.Close()
+		if _, err := bufio.NewReader(b).ReadString('\n'); err != nil {
+			return
+		}
+		b.Write(reply)
+	}()
+	t.Cleanup(func() { a.Close() })
+	return &Peer{Nick: "fake", conn: NewConn(a)}
+}
+
+// TestUnrequestedZL1 has a peer compress a file that was requested
+// plain, followed by another SND, which must still be readable.
+func TestUnrequestedZL1(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 512)
+	var reply bytes.Buffer
+	fmt.Fprintf(&reply, "CSND file files.xml.bz2 0 %d ZL1\n", len(data))
+	reply.Write(compress(t, data))
+	reply.WriteString("CSND file next 0 3\nxyz")
+
+	p := fakePeer(t, reply.Bytes())
+	r, err := p.get("file", "files.xml.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("data changed in decompression")
+	}
+
+	msg, err := p.conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Cmd != "SND" || msg.Params[1] != "next" {
+		t.Fatalf("out of step after ZL1, read %q", msg.String())
+	}
+}
+
+func TestCorruptZL1(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 512)
+	stream := compress(t, data)
+	stream[len(stream)-2] ^= 0xff
+	var reply bytes.Buffer
+	fmt.Fprintf(&reply, "CSND file files.xml.bz2 0 %d ZL1\n", len(data))
+	reply.Write(stream)
+
+	p := fakePeer(t, reply.Bytes())
+	r, err := p.get("file", "files.xml.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if _, err = io.ReadFull(r, buf); err == nil {
+		err = r.Close()
+	}
+	if err == nil {
+		t.Fatal("a bad checksum was accepted")
+	}
+}
+
+func TestSendData(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 4096)
+	for _, compress := range []bool{false, true} {
+		a, b := net.Pipe()
+		sender := NewConn(a)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- sender.sendData(bytes.NewReader(data), int64(len(data)), compress)
+		}()
+
+		p := &Peer{Nick: "fake", conn: NewConn(b)}
+		var flags []string
+		if compress {
+			flags = append(flags, "ZL1")
+		}
+		r, err := p.dataReader(flags, uint64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(data))
+		if _, err = io.ReadFull(r, buf); err == nil {
+			err = r.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("data changed in transfer, compress=%v", compress)
+		}
+		a.Close()
+		b.Close()
+	}
+}
@@ -3,6 +3,7 @@ package adc
 import (
 	"crypto/rand"
 	"fmt"
+	"strings"
 )
 
 type Search struct {
@@ -13,11 +14,36 @@ type SearchResult struct {
 	peer     *Peer
 	FullName string
 	size     uint64
+	tth      *TigerTreeHash
+	slots    int
+}
+
+// NewSearchResult returns a result for a file known to be held by
+// p, so that it may be fed to a DownloadDispatcher without a search.
+func NewSearchResult(p *Peer, fullName string, size uint64) *SearchResult {
+	return &SearchResult{peer: p, FullName: fullName, size: size, slots: -1}
+}
+
+func (r *SearchResult) Peer() *Peer { return r.peer }
+
+func (r *SearchResult) Size() uint64 { return r.size }
+
+// TTH returns the hash of the file, or nil if the peer did not give one.
+func (r *SearchResult) TTH() *TigerTreeHash { return r.tth }
+
+// Slots returns the number of free upload slots the peer
+// reported with the result, or -1 if it did not say.
+func (r *SearchResult) Slots() int { return r.slots }
+
+// IsDirectory reports whether the result is a directory.
+func (r *SearchResult) IsDirectory() bool {
+	return strings.HasSuffix(r.FullName, "/")
 }
 
 type SearchRequest struct {
-	Terms string
-	token string
+	Terms   string
+	token   string
+	typ     int
 	results chan *SearchResult
 }
 
@@ -29,6 +55,7 @@ func NewSearch() *SearchRequest {
 	}
 	return &SearchRequest{
 		token: fmt.Sprintf("%X", b),
+		typ:   1,
 	}
 }
 
@@ -44,6 +71,11 @@ func (s *SearchRequest) AddExclude(a string) {
 	s.Terms = s.Terms + " NO" + a
 }
 
+// SetDirectory makes the request search for directories rather than files.
+func (s *SearchRequest) SetDirectory() {
+	s.typ = 2
+}
+
 func (s *SearchRequest) SetResultChannel(c chan *SearchResult) {
 	s.results = c
 }
\ No newline at end of file
@@ -0,0 +1,292 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/dsnet/compress/bzip2"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Generator is written into the file lists we produce.
+const Generator = "go-adc 0.1"
+
+// the most leaves kept for each shared file
+const shareLeaves = 512
+
+// A Share is an index of local directories offered to other
+// clients. Each directory is shared under a virtual name at
+// the root of the file list.
+type Share struct {
+	// CID is written into generated file lists,
+	// it is set when the Share is given to a Hub.
+	CID string
+
+	mu     sync.RWMutex
+	roots  map[string]string // virtual name to local path
+	byPath map[string]*shareFile
+	byTTH  map[string]*shareFile
+	list   *FileList
+	bz2    []byte // cached files.xml.bz2
+	gen    uint64 // counts changes, so a stale bz2 is not cached
+	size   uint64
+}
+
+type shareFile struct {
+	path   string
+	size   uint64
+	tth    *TigerTreeHash
+	leaves [][]byte
+}
+
+func NewShare() *Share {
+	s := &Share{roots: make(map[string]string)}
+	s.index(nil)
+	return s
+}
+
+// AddDir hashes the files beneath path and adds them to the
+// share under name, replacing anything shared as name before.
+func (s *Share) AddDir(name, path string) error {
+	dir, files, err := hashDir(name, path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roots[name] = path
+	s.replace(name, dir, files)
+	return nil
+}
+
+// Remove stops sharing the directory shared as name.
+func (s *Share) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.roots, name)
+	s.replace(name, nil, nil)
+}
+
+// Refresh rehashes every shared directory.
+func (s *Share) Refresh() error {
+	s.mu.RLock()
+	roots := make(map[string]string, len(s.roots))
+	for name, path := range s.roots {
+		roots[name] = path
+	}
+	s.mu.RUnlock()
+	for name, path := range roots {
+		if err := s.AddDir(name, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the total size and count of the shared files.
+func (s *Share) Size() (size uint64, count int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size, len(s.byTTH)
+}
+
+// replace swaps the directory shared as name and rebuilds
+// the indices, must be called with mu held.
+func (s *Share) replace(name string, dir *FileListDir, files map[string]*shareFile) {
+	var dirs []*FileListDir
+	for _, d := range s.list.Dirs {
+		if d.Name != name {
+			dirs = append(dirs, d)
+		}
+	}
+	if dir != nil {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(dirsByName(dirs))
+
+	old := s.byPath
+	s.index(dirs)
+	for p, f := range old {
+		if !strings.HasPrefix(p, "/"+name+"/") {
+			s.add(p, f)
+		}
+	}
+	for p, f := range files {
+		s.add(p, f)
+	}
+}
+
+func (s *Share) index(dirs []*FileListDir) {
+	s.list = &FileList{
+		Version:     "1",
+		Base:        "/",
+		Generator:   Generator,
+		FileListDir: FileListDir{Dirs: dirs},
+	}
+	s.byPath = make(map[string]*shareFile)
+	s.byTTH = make(map[string]*shareFile)
+	s.bz2 = nil
+	s.gen++
+	s.size = 0
+}
+
+func (s *Share) add(path string, f *shareFile) {
+	s.byPath[path] = f
+	if _, ok := s.byTTH[f.tth.String()]; !ok {
+		s.size += f.size
+	}
+	s.byTTH[f.tth.String()] = f
+}
+
+// lookup finds a file by "TTH/..." identifier or by path.
+func (s *Share) lookup(identifier string) *shareFile {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if strings.HasPrefix(identifier, "TTH/") {
+		return s.byTTH[identifier[4:]]
+	}
+	return s.byPath[identifier]
+}
+
+// WriteFileList writes the uncompressed XML listing of the
+// directory base, such as "/" or "/music/". Unless recursive is
+// set, the contents of subdirectories are left out and they are
+// marked Incomplete, as for a partial list.
+func (s *Share) WriteFileList(w io.Writer, base string, recursive bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	d := s.list.Lookup(base)
+	if d == nil {
+		return Error("no such directory " + base)
+	}
+	l := &FileList{
+		Version:     s.list.Version,
+		CID:         s.CID,
+		Base:        base,
+		Generator:   s.list.Generator,
+		FileListDir: FileListDir{Dirs: d.Dirs, Files: d.Files},
+	}
+	if !recursive {
+		l.Dirs = make([]*FileListDir, len(d.Dirs))
+		for i, sub := range d.Dirs {
+			l.Dirs[i] = &FileListDir{
+				Name:       sub.Name,
+				Incomplete: Flag(len(sub.Dirs) > 0 || len(sub.Files) > 0),
+			}
+		}
+	}
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(l)
+}
+
+// CompressedFileList returns the complete list as files.xml.bz2,
+// the list is only regenerated after the share has changed.
+func (s *Share) CompressedFileList() ([]byte, error) {
+	s.mu.RLock()
+	b, gen := s.bz2, s.gen
+	s.mu.RUnlock()
+	if b != nil {
+		return b, nil
+	}
+
+	buf := new(bytes.Buffer)
+	z, err := bzip2.NewWriter(buf, &bzip2.WriterConfig{Level: bzip2.BestCompression})
+	if err != nil {
+		return nil, err
+	}
+	if err = s.WriteFileList(z, "/", true); err != nil {
+		return nil, err
+	}
+	if err = z.Close(); err != nil {
+		return nil, err
+	}
+
+	// the share may have changed while the list was written
+	s.mu.Lock()
+	if s.gen == gen {
+		s.bz2 = buf.Bytes()
+	}
+	s.mu.Unlock()
+	return buf.Bytes(), nil
+}
+
+// hashDir hashes the tree at root and returns its listing along
+// with the files it contains, keyed by path in the share.
+func hashDir(name, root string) (*FileListDir, map[string]*shareFile, error) {
+	top := &FileListDir{Name: name}
+	dirs := map[string]*FileListDir{root: top}
+	files := make(map[string]*shareFile)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		parent := dirs[filepath.Dir(path)]
+		if info.IsDir() {
+			d := &FileListDir{Name: info.Name()}
+			parent.Dirs = append(parent.Dirs, d)
+			dirs[path] = d
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := hashFile(path, uint64(info.Size()))
+		if err != nil {
+			return err
+		}
+		parent.Files = append(parent.Files, &FileListFile{
+			Name: info.Name(),
+			Size: f.size,
+			TTH:  f.tth.String(),
+			TS:   info.ModTime().Unix(),
+		})
+		rel, _ := filepath.Rel(root, path)
+		files["/"+name+"/"+filepath.ToSlash(rel)] = f
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return top, files, nil
+}
+
+func hashFile(path string, size uint64) (*shareFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	t := NewTreeHasher(int64(LeafBlockSize(size, shareLeaves)))
+	_, err = io.Copy(t, file)
+	if err != nil {
+		return nil, err
+	}
+	return &shareFile{
+		path:   path,
+		size:   size,
+		tth:    NewTigerTreeHashFromBytes(t.Root()),
+		leaves: t.Leaves(),
+	}, nil
+}
+
+type dirsByName []*FileListDir
+
+func (d dirsByName) Len() int           { return len(d) }
+func (d dirsByName) Less(i, j int) bool { return d[i].Name < d[j].Name }
+func (d dirsByName) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
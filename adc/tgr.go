@@ -3,6 +3,14 @@ package adc
 
 import (
 	"encoding/base32"
+	"github.com/3M3RY/go-thex"
+	"github.com/3M3RY/go-tiger"
+	"hash"
+)
+
+const (
+	tigerSize   = 24   // size of a Tiger digest
+	segmentSize = 1024 // size of the data segments at the base of a tree
 )
 
 type TigerTreeHash struct {
@@ -14,6 +22,11 @@ func (t *TigerTreeHash) String() string {
 	return t.cooked
 }
 
+// Bytes returns the raw hash.
+func (t *TigerTreeHash) Bytes() []byte {
+	return t.raw
+}
+
 func NewTigerTreeHash(s string) (*TigerTreeHash, error) {
 	b, err := base32.StdEncoding.DecodeString(s + "=")
 	if err != nil {
@@ -23,5 +36,109 @@ func NewTigerTreeHash(s string) (*TigerTreeHash, error) {
 }
 
 func NewTigerTreeHashFromBytes(b []byte) *TigerTreeHash {
-	return &TigerTreeHash{b, base32.StdEncoding.EncodeToString(b)}
-}
\ No newline at end of file
+	return &TigerTreeHash{b, Base32EncodeString(b)}
+}
+
+// A TreeHasher computes the Tiger tree hash of the data written to
+// it, keeping the level of the tree where each node covers a block
+// of blockSize bytes.
+type TreeHasher struct {
+	blockSize int64
+	tree      hash.Hash // tree over block hashes
+	block     hash.Hash // tree over segment hashes within a block
+	leaf      hash.Hash
+	seg       []byte // a segment prefixed with the 0x00 leaf marker
+	segN      int
+	blockN    int64
+	size      int64
+	leaves    [][]byte
+	root      []byte
+}
+
+// NewTreeHasher returns a TreeHasher keeping leaves at blockSize,
+// which must be 1024 multiplied by a power of two.
+func NewTreeHasher(blockSize int64) *TreeHasher {
+	if blockSize < segmentSize {
+		blockSize = segmentSize
+	}
+	return &TreeHasher{
+		blockSize: blockSize,
+		tree:      thex.New(tiger.New()),
+		block:     thex.New(tiger.New()),
+		leaf:      tiger.New(),
+		seg:       make([]byte, segmentSize+1),
+	}
+}
+
+func (t *TreeHasher) Write(p []byte) (n int, err error) {
+	if t.root != nil {
+		panic("TreeHasher written to after Root")
+	}
+	n = len(p)
+	t.size += int64(n)
+	for len(p) > 0 {
+		m := copy(t.seg[1+t.segN:], p)
+		t.segN += m
+		p = p[m:]
+		if t.segN == segmentSize {
+			t.flushSegment()
+		}
+	}
+	return
+}
+
+func (t *TreeHasher) flushSegment() {
+	t.leaf.Reset()
+	t.leaf.Write(t.seg[:t.segN+1])
+	t.block.Write(t.leaf.Sum(nil))
+	t.blockN += int64(t.segN)
+	t.segN = 0
+	if t.blockN == t.blockSize {
+		t.flushBlock()
+	}
+}
+
+func (t *TreeHasher) flushBlock() {
+	h := t.block.Sum(nil)
+	t.leaves = append(t.leaves, h)
+	t.tree.Write(h)
+	t.block = thex.New(tiger.New())
+	t.blockN = 0
+}
+
+// Root completes the tree and returns the root hash,
+// nothing more may be written after Root is called.
+func (t *TreeHasher) Root() []byte {
+	if t.root != nil {
+		return t.root
+	}
+	if t.segN > 0 || t.size == 0 {
+		t.flushSegment()
+	}
+	if t.blockN > 0 || len(t.leaves) == 0 {
+		t.flushBlock()
+	}
+	t.root = t.tree.Sum(nil)
+	return t.root
+}
+
+// Leaves completes the tree and returns the hashes of each block.
+func (t *TreeHasher) Leaves() [][]byte {
+	t.Root()
+	return t.leaves
+}
+
+// Size returns the number of bytes written.
+func (t *TreeHasher) Size() int64 {
+	return t.size
+}
+
+// LeafBlockSize returns the size of data covered by each of count
+// leaves in the tree of a file of the given size.
+func LeafBlockSize(size uint64, count int) uint64 {
+	b := uint64(segmentSize)
+	for (size+b-1)/b > uint64(count) {
+		b *= 2
+	}
+	return b
+}
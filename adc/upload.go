@@ -0,0 +1,179 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// SetShare offers s to the clients on the hub with up to
+// slots concurrent uploads, and announces its size.
+func (h *Hub) SetShare(s *Share, slots int) {
+	s.CID = h.cid.String()
+	h.shareMu.Lock()
+	h.share = s
+	h.uploadSlots = make(chan bool, slots)
+	h.shareMu.Unlock()
+	size, count := s.Size()
+	h.conn.WriteLine("BINF %s SS%d SF%d SL%d", h.sid, size, count, slots)
+}
+
+// sharing returns the Share offered on the hub, nil if
+// there is none, and the channel that limits its uploads.
+func (h *Hub) sharing() (*Share, chan bool) {
+	h.shareMu.Lock()
+	defer h.shareMu.Unlock()
+	return h.share, h.uploadSlots
+}
+
+// upload connects to a Peer that sent a CTM and serves
+// its requests until it disconnects.
+func (h *Hub) upload(p *Peer, port, token string) {
+	var c net.Conn
+	var err error
+	if len(p.I4) > 8 {
+		c, err = net.Dial("tcp4", net.JoinHostPort(p.I4, port))
+	} else if len(p.I6) > 8 {
+		c, err = net.Dial("tcp6", net.JoinHostPort(p.I6, port))
+	} else {
+		err = Error("no address information for peer")
+	}
+	if err != nil {
+		h.log.Printf("could not connect to %s for upload: %s", p.Nick, err)
+		return
+	}
+	conn := NewConn(c)
+	defer conn.Close()
+
+	conn.WriteLine("CSUP ADBASE ADTIGR ADZLIG")
+	msg, err := conn.ReadMessage()
+	if err != nil || msg.Cmd != "SUP" {
+		return
+	}
+	zlig := false
+	for _, word := range msg.Params {
+		if word == "ADZLIG" {
+			zlig = true
+		}
+	}
+	conn.WriteLine("CINF ID%s TO%s", h.cid, token)
+	msg, err = conn.ReadMessage()
+	if err != nil || msg.Cmd != "INF" {
+		return
+	}
+
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msg.Cmd != "GET" {
+			continue
+		}
+		if len(msg.Params) < 4 {
+			conn.WriteLine("CSTA 140 Invalid\\sarguments.")
+			continue
+		}
+		err = h.serveGet(p, conn, msg.Params, zlig)
+		if err != nil {
+			h.log.Printf("upload to %s failed: %s", p.Nick, err)
+			return
+		}
+	}
+}
+
+// serveGet answers a single GET, a non-nil error means
+// the connection is no longer usable.
+func (h *Hub) serveGet(p *Peer, conn *Conn, params []string, zlig bool) error {
+	typ := params[0]
+	identifier := fmt.Sprintf("%s", NewParameterValue(params[1]))
+	var start, n int64
+	_, err := fmt.Sscan(params[2], &start)
+	if err == nil {
+		_, err = fmt.Sscan(params[3], &n)
+	}
+	if err != nil || start < 0 {
+		return conn.WriteLine("CSTA 140 Invalid\\sarguments.")
+	}
+	var compress, recursive bool
+	for _, flag := range params[4:] {
+		switch flag {
+		case "ZL1":
+			compress = zlig
+		case "RE1":
+			recursive = true
+		}
+	}
+
+	share, slots := h.sharing()
+	var r io.ReadSeeker
+	var size int64
+	switch {
+	case typ == "file" && identifier == "files.xml.bz2":
+		b, err := share.CompressedFileList()
+		if err != nil {
+			return conn.WriteLine("CSTA 150 %v", NewParameterValue(err.Error()))
+		}
+		r, size = bytes.NewReader(b), int64(len(b))
+
+	case typ == "list":
+		buf := new(bytes.Buffer)
+		if err := share.WriteFileList(buf, identifier, recursive); err != nil {
+			return conn.WriteLine("CSTA 151 File\\snot\\savailable")
+		}
+		r, size = bytes.NewReader(buf.Bytes()), int64(buf.Len())
+
+	case typ == "file":
+		f := share.lookup(identifier)
+		if f == nil {
+			return conn.WriteLine("CSTA 151 File\\snot\\savailable")
+		}
+		select {
+		case slots <- true:
+			defer func() { <-slots }()
+		default:
+			return conn.WriteLine("CSTA 153 Slots\\sfull")
+		}
+		file, err := os.Open(f.path)
+		if err != nil {
+			return conn.WriteLine("CSTA 151 File\\snot\\savailable")
+		}
+		defer file.Close()
+		r, size = file, int64(f.size)
+
+	case typ == "tthl":
+		f := share.lookup(identifier)
+		if f == nil {
+			return conn.WriteLine("CSTA 151 File\\snot\\savailable")
+		}
+		b := bytes.Join(f.leaves, nil)
+		r, size = bytes.NewReader(b), int64(len(b))
+
+	default:
+		return conn.WriteLine("CSTA 140 Unknown\\stype")
+	}
+
+	if start > size {
+		return conn.WriteLine("CSTA 140 Invalid\\sfile\\srange")
+	}
+	if n < 0 || start+n > size {
+		n = size - start
+	}
+	if _, err := r.Seek(start, 0); err != nil {
+		return err
+	}
+
+	flags := ""
+	if compress {
+		flags = " ZL1"
+	}
+	err = conn.WriteLine("CSND %s %s %d %d%s", typ, params[1], start, n, flags)
+	if err != nil {
+		return err
+	}
+	return conn.sendData(r, n, compress, UploadLimit, p.UploadLimit)
+}
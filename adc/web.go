@@ -0,0 +1,94 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webWorker fetches chunks from an HTTP URL with range requests,
+// giving up on the URL at the first failure.
+func webWorker(d *DownloadDispatcher, rawurl string) {
+	d.addSource(1)
+	defer d.addSource(-1)
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		d.log.Printf("bad web source %s: %s", rawurl, err)
+		return
+	}
+
+	requestSize := uint64(65536)
+	for {
+		chunk := d.getChunk(requestSize)
+		if chunk == nil {
+			break
+		}
+
+		startOfTransfer := time.Now()
+		buf, err := getRange(u, chunk)
+		if err != nil {
+			d.log.Printf("dropping %s: %s", u.Host, err)
+			d.returnChunk(chunk)
+			return
+		}
+		duration := time.Since(startOfTransfer)
+
+		_, err = d.output.WriteAt(buf, int64(chunk.start))
+		if err != nil {
+			d.log.Println(err)
+			d.returnChunk(chunk)
+			return
+		}
+		d.chunkDone(chunk, false, u.Host, float64(chunk.size)/duration.Seconds())
+
+		// grow as downloadWorker does
+		if duration < time.Minute && requestSize*2 <= maxChunkSize {
+			requestSize *= 2
+		} else if duration > time.Minute*4 && requestSize/2 >= 65536 {
+			requestSize /= 2
+		}
+	}
+}
+
+// getRange fetches a single chunk of u.
+func getRange(u *url.URL, c *fileChunk) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", c.start, c.start+c.size-1))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		var start uint64
+		fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-", &start)
+		if start != c.start {
+			return nil, Error("server sent the wrong range")
+		}
+	case http.StatusOK:
+		// the server ignored the range, which is only
+		// of use if the range was the whole file
+		if c.start != 0 || uint64(res.ContentLength) != c.size {
+			return nil, Error("server does not support range requests")
+		}
+	default:
+		return nil, Error(res.Status)
+	}
+
+	buf := make([]byte, c.size)
+	r := newLimitedReader(bufio.NewReader(res.Body), DownloadLimit)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"compress/flate"
+	"compress/zlib"
+	"io"
+)
+
+// zlibReader decompresses a ZL1 stream of a known length. It
+// reads from a flate.Reader so that the decompressor never takes
+// more than the compressed stream from the connection. Close
+// reads through the zlib checksum and reports if it is bad.
+type zlibReader struct {
+	z    io.ReadCloser
+	left uint64
+}
+
+func newZlibReader(r flate.Reader, size uint64) (*zlibReader, error) {
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &zlibReader{z, size}, nil
+}
+
+func (r *zlibReader) Read(b []byte) (n int, err error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(b)) > r.left {
+		b = b[:r.left]
+	}
+	n, err = r.z.Read(b)
+	r.left -= uint64(n)
+	if err == io.EOF {
+		if r.left > 0 {
+			err = io.ErrUnexpectedEOF
+		} else {
+			err = nil
+		}
+	}
+	return
+}
+
+// Close consumes the remainder of the stream, which should be
+// nothing but the checksum, and returns an error if it is not
+// there or does not match. The connection is out of step if so.
+func (r *zlibReader) Close() error {
+	if r.left > 0 {
+		return Error("ZL1 stream closed before its end")
+	}
+	var b [1]byte
+	n, err := io.ReadFull(r.z, b[:])
+	if n > 0 {
+		return Error("ZL1 stream is longer than announced")
+	}
+	if err != io.EOF {
+		return err
+	}
+	return r.z.Close()
+}
+
+// sendData writes n bytes from r to the connection, compressing
+// them as a ZL1 stream if compress is set. Limits apply to the
+// bytes as they go out on the wire.
+func (c *Conn) sendData(r io.Reader, n int64, compress bool, limiters ...*RateLimiter) error {
+	w := io.Writer(newLimitedWriter(c.W, limiters...))
+	if compress {
+		z := zlib.NewWriter(w)
+		if _, err := io.CopyN(z, r, n); err != nil {
+			return err
+		}
+		if err := z.Close(); err != nil {
+			return err
+		}
+	} else {
+		if _, err := io.CopyN(w, r, n); err != nil {
+			return err
+		}
+	}
+	return c.W.Flush()
+}
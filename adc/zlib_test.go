@@ -0,0 +1,70 @@
+// Copyright 2013 Emery Hemingway.  All rights reserved
+
+package adc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"testing"
+)
+
+func compress(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	if _, err := z.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readZL1 reads size bytes of a ZL1 stream as the callers of
+// dataReader do, and returns the result of Close.
+func readZL1(t *testing.T, stream []byte, size uint64) ([]byte, error) {
+	r, err := newZlibReader(bytes.NewReader(stream), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, size)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return buf, err
+	}
+	return buf, r.Close()
+}
+
+func TestZlibReader(t *testing.T) {
+	data := bytes.Repeat([]byte("the quick brown fox "), 1000)
+	buf, err := readZL1(t, compress(t, data), uint64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("data changed in decompression")
+	}
+}
+
+func TestZlibReaderChecksum(t *testing.T) {
+	data := bytes.Repeat([]byte("the quick brown fox "), 1000)
+	stream := compress(t, data)
+	stream[len(stream)-1] ^= 0xff
+	if _, err := readZL1(t, stream, uint64(len(data))); err == nil {
+		t.Fatal("a bad checksum was accepted")
+	}
+}
+
+func TestZlibReaderLonger(t *testing.T) {
+	data := bytes.Repeat([]byte("the quick brown fox "), 1000)
+	if _, err := readZL1(t, compress(t, data), uint64(len(data)-1)); err == nil {
+		t.Fatal("a stream longer than announced was accepted")
+	}
+}
+
+func TestZlibReaderShorter(t *testing.T) {
+	data := bytes.Repeat([]byte("the quick brown fox "), 1000)
+	if _, err := readZL1(t, compress(t, data), uint64(len(data)+1)); err == nil {
+		t.Fatal("a stream shorter than announced was accepted")
+	}
+}
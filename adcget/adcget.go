@@ -1,200 +1,512 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"github.com/3M3RY/go-adc/adc"
-	"github.com/3M3RY/go-tiger"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Exit codes
+const (
+	exitOK       = 0
+	exitError    = 1 // anything not covered below, such as a local I/O error
+	exitUsage    = 2 // bad arguments
+	exitNotFound = 3 // no source had the file
+	exitVerify   = 4 // the file did not match its hash
+	exitNetwork  = 5 // no hub or server could be reached
+)
+
+// how much out of order data to hold when streaming to stdout
+const streamWindow = 1 << 26
+
+// where an output of "-" is written, a metalink download
+// puts its hashes between this and os.Stdout
+var stdout io.Writer = os.Stdout
+
 var ( // Commandline switches
 	searchTTH      string
 	outputFilename string
 	start          time.Time
 	searchTimeout  time.Duration
 	compress       bool
+	limitRate      string
+	peerLimitRate  string
+	peerRate       uint64 // parsed from peerLimitRate
+	recursive      bool
+	peerName       string
+	hubFlags       hubList
+	configPath     string
+	inputList      string
+	parallel       int
+	searchTerms    string
+	listSources    bool
+	jsonOutput     bool
 )
 
+// hubList collects repeated -hub flags.
+type hubList []string
+
+func (l *hubList) String() string { return strings.Join(*l, ",") }
+
+func (l *hubList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
 func init() {
 	flag.StringVar(&searchTTH, "tth", "LWPNACQDBZRYXW3VHJVCJ64QBZNGHOHHHZWCLNQ", "search for a given Tiger tree hash")
-	flag.StringVar(&outputFilename, "output", "", "output download to given file")
+	flag.StringVar(&outputFilename, "output", "", "output download to given file, or - for stdout")
 	flag.DurationVar(&searchTimeout, "timeout", time.Duration(8)*time.Second, "ADC search timeout")
-	// NOT TESTED WITH A CLIENT THAT COMPLIES WITH COMPRESSION REQUEST
-	flag.BoolVar(&compress, "compress", false, "EXPERIMENTAL: compress data transfer")
+	flag.BoolVar(&compress, "compress", false, "request compressed data transfer from peers that support it")
+	flag.BoolVar(&recursive, "r", false, "download a directory and everything beneath it")
+	flag.StringVar(&peerName, "peer", "", "nick or CID of the peer to download a directory from")
+	flag.Var(&hubFlags, "hub", "an additional hub to search, may be given more than once")
+	flag.StringVar(&configPath, "config", "", "config file, by default adcget.conf in the user config directory")
+	flag.StringVar(&limitRate, "limit-rate", "", "limit download rate to bytes per second, k, m and g suffixes allowed")
+	flag.StringVar(&peerLimitRate, "peer-limit-rate", "", "limit download rate from each peer to bytes per second, k, m and g suffixes allowed")
+	flag.StringVar(&inputList, "i", "", "download every URL or magnet link listed in a file, or - for stdin, into the -output directory")
+	flag.IntVar(&parallel, "j", 4, "how many downloads to run at once with -i")
+	flag.StringVar(&searchTerms, "search", "", "print the results of searching for the given terms rather than downloading, a term starting with '-' excludes")
+	flag.BoolVar(&listSources, "list-sources", false, "print the peers that have the file given by -tth rather than downloading")
+	flag.BoolVar(&jsonOutput, "json", false, "print -search and -list-sources results as JSON lines")
 	start = time.Now()
 }
 
 func main() {
 	flag.Parse()
 	if len(os.Args) == 1 {
-		fmt.Println(os.Args[0], "is a utility for downloading files from ADC hubs as well as traditional http and https services.")
-		fmt.Println("It may be used as the Portage fetch command by adding the following to make.conf:")
-		fmt.Println("FETCHCOMMAND=\"adcget -output \\\"\\${DISTDIR}/\\${FILE}\\\" \\\"\\${URI}\\\"\"")
-		fmt.Println("\nUsage:", os.Args[0], "[OPTIONS] URL")
-		fmt.Println("Options:")
-		flag.PrintDefaults()
-		os.Exit(-1)
+		usage()
+		os.Exit(exitUsage)
 	}
 
-	url, err := url.Parse(flag.Arg(0))
-	if err != nil {
-		fmt.Println("URL error", err)
-		os.Exit(1)
+	path := configPath
+	if path == "" {
+		path = defaultConfigPath()
+	}
+	if path != "" {
+		if err := loadConfig(path, configPath != ""); err != nil {
+			fail(exitUsage, "Error reading config,", err)
+		}
 	}
 
 	logger := log.New(os.Stderr, "\r", 0)
 
-	if url.Scheme == "magnet" {
-		var ok bool
-		var ss []string
-		values := url.Query()
+	if limitRate != "" {
+		rate, err := parseRate(limitRate)
+		if err != nil {
+			fail(exitUsage, "Invalid rate limit,", err)
+		}
+		adc.DownloadLimit.SetRate(rate)
+	}
+	if peerLimitRate != "" {
+		var err error
+		peerRate, err = parseRate(peerLimitRate)
+		if err != nil {
+			fail(exitUsage, "Invalid rate limit,", err)
+		}
+	}
+
+	if inputList != "" {
+		if parallel < 1 {
+			fail(exitUsage, "-j must be at least 1")
+		}
+		batch(inputList, logger)
+	}
+
+	target, err := url.Parse(flag.Arg(0))
+	if err != nil {
+		fail(exitUsage, "URL error", err)
+	}
 
-		if ss, ok = values["dn"]; ok {
-			outputFilename = ss[0]
+	var hubs []*url.URL
+	for _, s := range hubFlags {
+		u, err := url.Parse(s)
+		if err != nil {
+			fail(exitUsage, "Error parsing hub url,", err)
 		}
-		if ss, ok = values["xt"]; ok {
-			s := ss[0]
-			i := strings.Index(s, "urn:tree:tiger:")
-			if i == -1 {
-				fmt.Println("tiger tree hash not specified in magnet link")
-				os.Exit(1)
-			}
-			i += 15
-			searchTTH = s[i : i+39]
+		hubs = append(hubs, u)
+	}
+
+	if searchTerms != "" || listSources {
+		if flag.NArg() > 0 {
+			hubs = append([]*url.URL{target}, hubs...)
+		}
+		searchClient(hubs, logger)
+	}
+
+	if isMetalink(target) {
+		metalinkClient(target, hubs, logger)
+	}
+
+	if target.Scheme == "magnet" {
+		m, err := adc.ParseMagnet(flag.Arg(0))
+		if err != nil {
+			fail(exitUsage, "Error parsing magnet link,", err)
+		}
+		if outputFilename == "" {
+			outputFilename = m.DisplayName
+		}
+		if m.TTH == nil {
+			fail(exitUsage, "tiger tree hash not specified in magnet link")
 		}
-		if ss, ok = values["xs"]; ok {
-			url, err = url.Parse(ss[0])
+		searchTTH = m.TTH.String()
+
+		var webSources []*url.URL
+		sources := append(m.ExactSources, m.AcceptableSources...)
+		for _, s := range append(sources, m.WebSources...) {
+			u, err := url.Parse(s)
 			if err != nil {
-				fmt.Println("Error parsing magnet XS url,", err)
-				os.Exit(1)
+				fail(exitUsage, "Error parsing magnet source url,", err)
+			}
+			switch u.Scheme {
+			case "adc", "adcs":
+				hubs = append(hubs, u)
+			case "http", "https":
+				webSources = append(webSources, u)
 			}
-		} else {
-			fmt.Println("Hub url not encoded in magnet link, cannot continue")
-			os.Exit(1)
 		}
+		if len(hubs) == 0 && len(webSources) == 0 {
+			fail(exitUsage, "Neither hub nor http url encoded in magnet link, cannot continue")
+		}
+		magnetClient(hubs, webSources, m.TTH, m.Size, logger)
 	}
-	switch url.Scheme {
+	switch target.Scheme {
 	case "adc", "adcs":
-		adcClient(url, logger)
+		adcClient(append([]*url.URL{target}, hubs...), target, logger)
 	case "http", "https":
-		httpClient(url)
+		httpClient(target)
 	default:
-		logger.Fatalln("Unsupported or unknown url scheme: ", url.Scheme)
+		fail(exitUsage, "Unsupported or unknown url scheme:", target.Scheme)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, os.Args[0], "is a utility for downloading files from ADC hubs as well as traditional http and https services.")
+	fmt.Fprintln(os.Stderr, "It may be used as the Portage fetch command by adding the following to make.conf:")
+	fmt.Fprintln(os.Stderr, "FETCHCOMMAND=\"adcget -output \\\"\\${DISTDIR}/\\${FILE}\\\" \\\"\\${URI}\\\"\"")
+	fmt.Fprintln(os.Stderr, "\nUsage:", os.Args[0], "[OPTIONS] URL")
+	fmt.Fprintln(os.Stderr, "A URL or file ending in .meta4 or .metalink is read as a Metalink.")
+	fmt.Fprintln(os.Stderr, "Options:")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprint(os.Stderr, configHelp)
+	fmt.Fprintln(os.Stderr, "\nAn output of \"-\" streams the download to stdout.")
+	fmt.Fprintln(os.Stderr, "Exit codes:")
+	fmt.Fprintln(os.Stderr, "\t0 success")
+	fmt.Fprintln(os.Stderr, "\t1 any other error, such as failing to write the output")
+	fmt.Fprintln(os.Stderr, "\t2 bad arguments")
+	fmt.Fprintln(os.Stderr, "\t3 the file was not found")
+	fmt.Fprintln(os.Stderr, "\t4 the file failed verification")
+	fmt.Fprintln(os.Stderr, "\t5 network error, no hub or server could be reached")
+}
+
+// fail prints a diagnostic and exits with code.
+func fail(code int, a ...interface{}) {
+	fmt.Fprintln(os.Stderr, a...)
+	os.Exit(code)
+}
+
+// done reports a completed download and exits.
+func done(size int64) {
+	fmt.Fprintf(os.Stderr, "\nDownloaded %d bytes in %s\n", size, time.Since(start))
+	os.Exit(exitOK)
+}
+
+// exitCode picks the exit code for a failed download.
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case verifyError:
+		return exitVerify
+	case notFoundError:
+		return exitNotFound
+	case *httpStatusError:
+		if e.code == http.StatusNotFound || e.code == http.StatusGone {
+			return exitNotFound
+		}
+		return exitNetwork
+	case net.Error, networkError:
+		return exitNetwork
+	case usageError:
+		return exitUsage
 	}
+	return exitError
 }
 
-func adcClient(url *url.URL, logger *log.Logger) {
-	hostname, err := os.Hostname()
+// notFoundError is a search that turned up no sources.
+type notFoundError string
+
+func (e notFoundError) Error() string { return string(e) }
+
+// usageError is a problem with the arguments given.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// networkError is a failure to reach any hub.
+type networkError string
+
+func (e networkError) Error() string { return string(e) }
+
+// parseRate parses a rate in the style of wget --limit-rate,
+// such as "20k" or "1.5m".
+func parseRate(s string) (uint64, error) {
+	mult := float64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		mult = 1 << 10
+	case 'm', 'M':
+		mult = 1 << 20
+	case 'g', 'G':
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	f, err := strconv.ParseFloat(s, 64)
 	if err != nil {
-		fmt.Printf("error: could not generate client PID, %s\n", err)
+		return 0, err
 	}
-	hash := tiger.New()
-	fmt.Fprint(hash, hostname, os.Getuid)
-	pid := adc.NewPrivateID(hash.Sum(nil))
+	if f < 0 {
+		return 0, fmt.Errorf("negative rate %s", s)
+	}
+	return uint64(f * mult), nil
+}
 
-	hub, err := adc.NewHub(pid, url, logger)
+// adcClient searches every hub for the file named by the path
+// of target, or by the TTH, and downloads it from all of them.
+func adcClient(hubURLs []*url.URL, target *url.URL, logger *log.Logger) {
+	size, err := adcDownload(hubURLs, target, logger)
 	if err != nil {
-		fmt.Printf("Could not connect; %s\n", err)
-		return
+		fail(exitCode(err), err)
 	}
+	done(int64(size))
+}
 
-	var done chan uint64
-	search := adc.NewSearch()
-	var config *adc.DownloadConfig
+func adcDownload(hubURLs []*url.URL, target *url.URL, logger *log.Logger) (uint64, error) {
+	pid := identity(logger)
+
+	hubs := connectHubs(pid, hubURLs, logger)
+	if len(hubs) == 0 {
+		return 0, networkError("Could not connect to any hub")
+	}
+
+	if recursive {
+		mirror(hubs[0], target, logger)
+	}
 
+	var tth *adc.TigerTreeHash
+	var name string
 	if searchTTH != "LWPNACQDBZRYXW3VHJVCJ64QBZNGHOHHHZWCLNQ" {
 		if fmt.Sprint(outputFilename) == "" {
-			fmt.Println("No output file specified, exiting.")
-			return
+			return 0, usageError("No output file specified, exiting.")
 		}
-		tth, err := adc.NewTigerTreeHash(searchTTH)
+		var err error
+		tth, err = adc.NewTigerTreeHash(searchTTH)
 		if err != nil {
-			logger.Fatal("Invalid TTH:", err)
+			return 0, usageError(fmt.Sprintf("Invalid TTH: %s", err))
 		}
-		search.AddTTH(tth)
+	} else {
+		elements := strings.Split(target.Path, "/")
+		name = elements[len(elements)-1]
+	}
+	size, _, err := fetchADC(hubs, name, tth, outputFilename, isTerminal(os.Stderr), logger)
+	return size, err
+}
 
-		config = &adc.DownloadConfig{
-			OutputFilename: outputFilename,
-			Hash:           tth,
+// fetchADC searches hubs for a file by TTH, or else by name, and
+// downloads it to output, named after the file if output is empty.
+// It returns the size of the file and the nicks of the peers that
+// sent any of it.
+func fetchADC(hubs []*adc.Hub, name string, tth *adc.TigerTreeHash, output string, progress bool, logger *log.Logger) (uint64, []string, error) {
+	config := &adc.DownloadConfig{
+		OutputFilename: output,
+		Hash:           tth,
+	}
+	if tth == nil {
+		if output == "" {
+			config.OutputFilename = name
 		}
+		config.SearchFilename = name
+	}
+	return fetch(hubs, config, progress, logger)
+}
 
+// fetch searches hubs for the file described by config and downloads it.
+func fetch(hubs []*adc.Hub, config *adc.DownloadConfig, progress bool, logger *log.Logger) (uint64, []string, error) {
+	search := adc.NewSearch()
+	if config.Hash != nil {
+		search.AddTTH(config.Hash)
 	} else {
-		elements := strings.Split(url.Path, "/")
-		searchFilename := elements[len(elements)-1]
-		search.AddInclude(searchFilename)
-
-		if fmt.Sprint(outputFilename) == "" {
-			config = &adc.DownloadConfig{
-				OutputFilename: searchFilename,
-				SearchFilename: searchFilename,
-			}
-		} else {
-			config = &adc.DownloadConfig{
-				OutputFilename: outputFilename,
-				SearchFilename: searchFilename,
-			}
-		}
+		search.AddInclude(config.SearchFilename)
 	}
 
 	config.Compress = compress
+	if config.OutputFilename == "-" {
+		config.Output = adc.NewOrderedWriter(stdoutStream(), streamWindow)
+	}
 	dispatcher, _ := adc.NewDownloadDispatcher(config, logger)
 	search.SetResultChannel(dispatcher.ResultChannel())
-	done = dispatcher.FinalChannel()
+	done := dispatcher.FinalChannel()
+
+	if progress {
+		c := make(chan *adc.Progress, 1)
+		dispatcher.SetProgressChannel(c)
+		go renderProgress(c)
+	}
 
-	hub.Search(search)
+	for _, hub := range hubs {
+		hub.Search(search)
+	}
 	dispatcher.Run(searchTimeout)
 
 	size := <-done
 	if size == 0 {
-		fmt.Println("failed to find", outputFilename)
-		os.Exit(-1)
-	} else {
-		fmt.Printf("\nDownloaded %d bytes in %s\n", size, time.Since(start))
-		os.Exit(0)
+		// what the peers left behind has holes in it, and would
+		// be taken as a good start by an HTTP download resuming it
+		if dispatcher.Partial() {
+			os.Remove(config.OutputFilename)
+		}
+		return 0, nil, notFoundError("failed to find " + config.OutputFilename)
 	}
+	return size, dispatcher.Sources(), nil
 }
 
-func httpClient(url *url.URL) {
-	var fileName string
-	if fmt.Sprint(outputFilename) == "" {
-		elements := strings.Split(url.Path, "/")
-		fileName = elements[len(elements)-1]
-		if fmt.Sprint(outputFilename) == "" {
-			outputFilename = fileName
+// magnetClient downloads the file of a magnet link. When the size is
+// known the peers and http sources work on the file together, otherwise
+// the hubs are tried first and, if no peer has the file, the http
+// sources in turn.
+func magnetClient(hubs, webSources []*url.URL, tth *adc.TigerTreeHash, size uint64, logger *log.Logger) {
+	if size != 0 && len(webSources) > 0 {
+		config := &adc.DownloadConfig{
+			OutputFilename: outputFilename,
+			Hash:           tth,
+			Size:           size,
+		}
+		if config.OutputFilename == "" {
+			config.OutputFilename = outputName(webSources[0])
+		}
+		for _, u := range webSources {
+			config.WebSources = append(config.WebSources, u.String())
+		}
+		var peerHubs []*adc.Hub
+		if len(hubs) > 0 {
+			peerHubs = connectHubs(identity(logger), hubs, logger)
+		}
+		n, _, err := fetch(peerHubs, config, isTerminal(os.Stderr), logger)
+		if err == nil {
+			done(int64(n))
 		}
+		// the peers have been asked, but a server without range
+		// requests may still send the whole file
+		logger.Println(err)
+		hubs = nil
 	}
+	if len(hubs) > 0 {
+		size, err := adcDownload(hubs, nil, logger)
+		if err == nil {
+			done(int64(size))
+		}
+		if len(webSources) == 0 {
+			fail(exitCode(err), err)
+		}
+		logger.Println(err)
+	}
+	var err error
+	for _, u := range webSources {
+		logger.Println("falling back to", u)
+		name := outputFilename
+		if name == "" {
+			name = outputName(u)
+		}
+		var n int64
+		n, err = httpFetch(u, name, tth)
+		if err == nil {
+			done(n)
+		}
+		logger.Println(err)
+	}
+	os.Exit(exitCode(err))
+}
 
-	file, err := os.Create(outputFilename)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+// connectHubs connects to each hub at once, returning those
+// that could be reached.
+func connectHubs(pid *adc.Identifier, urls []*url.URL, logger *log.Logger) []*adc.Hub {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var hubs []*adc.Hub
+	seen := make(map[string]bool)
+	for _, u := range urls {
+		if seen[u.Host] {
+			continue
+		}
+		seen[u.Host] = true
+		configureHub(u)
+		wg.Add(1)
+		go func(u *url.URL) {
+			defer wg.Done()
+			hub, err := adc.NewHub(pid, u, logger)
+			if err != nil {
+				logger.Printf("Could not connect to %s; %s", u.Host, err)
+				return
+			}
+			hub.SetPeerRateLimits(peerRate, 0)
+			mu.Lock()
+			hubs = append(hubs, hub)
+			mu.Unlock()
+		}(u)
 	}
+	wg.Wait()
+	return hubs
+}
 
-	res, err := http.Get(url.String())
+// isTerminal reports whether f is a character device,
+// progress is not drawn into logs or pipes.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+		return false
 	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
 
-	w := bufio.NewWriter(file)
-
-	n := int64(1)
-	for n > 0 {
-		n, err = io.Copy(w, res.Body)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(-1)
+func renderProgress(c chan *adc.Progress) {
+	const width = 30
+	for p := range c {
+		var rate float64
+		for _, r := range p.Peers {
+			rate += r
+		}
+		var percent uint64
+		if p.Size > 0 {
+			percent = p.Done * 100 / p.Size
+		}
+		fill := int(percent * width / 100)
+		bar := strings.Repeat("=", fill) + strings.Repeat(" ", width-fill)
+		eta := "--:--"
+		if p.ETA > 0 {
+			eta = p.ETA.Round(time.Second).String()
 		}
+		fmt.Fprintf(os.Stderr, "\r[%s] %3d%% %s/s, %d sources, ETA %s   ",
+			bar, percent, formatBytes(rate), p.Sources, eta)
+	}
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
 	}
-	w.Flush()
-	//fmt.Printf("\nDownloaded %d bytes in %s\n", n, time.Since(start))
-	os.Exit(0)
+	return fmt.Sprintf("%.1f %s", n, units[i])
 }
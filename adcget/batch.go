@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/3M3RY/go-adc/adc"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// batchItem is a single line of a batch input file.
+type batchItem struct {
+	raw        string
+	name       string // file name to save as
+	searchName string // name to search for when there is no TTH
+	tth        *adc.TigerTreeHash
+	hubs       []*url.URL
+	webSources []*url.URL
+}
+
+// batchReport is written as a JSON line for each item.
+type batchReport struct {
+	URL     string   `json:"url"`
+	Path    string   `json:"path"`
+	TTH     string   `json:"tth,omitempty"`
+	Size    int64    `json:"size"`
+	Status  string   `json:"status"`
+	Sources []string `json:"sources,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	code    int
+}
+
+var statusNames = map[int]string{
+	exitOK:       "ok",
+	exitError:    "error",
+	exitUsage:    "bad item",
+	exitNotFound: "not found",
+	exitVerify:   "verification failed",
+	exitNetwork:  "network error",
+}
+
+// batch downloads every URL or magnet link listed in the file at
+// name, or stdin for "-", into the -output directory. Each hub is
+// logged into once, and a report is written to stdout.
+func batch(name string, logger *log.Logger) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			fail(exitUsage, err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	dir := outputFilename
+	if dir == "" {
+		dir = "."
+	}
+
+	var items []*batchItem
+	var hubURLs []*url.URL
+	for _, s := range hubFlags {
+		u, err := url.Parse(s)
+		if err != nil {
+			fail(exitUsage, "Error parsing hub url,", err)
+		}
+		hubURLs = append(hubURLs, u)
+	}
+	// items that would be written to the same file are not
+	// downloaded at once, only the first of them is fetched
+	var skipped []*batchReport
+	claimed := make(map[string]string) // destination to the item taking it
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		item, err := parseBatchItem(line)
+		if err != nil {
+			fail(exitUsage, line+":", err)
+		}
+		dest := filepath.Join(dir, item.name)
+		if first, ok := claimed[dest]; ok {
+			skipped = append(skipped, &batchReport{
+				URL:    line,
+				Path:   dest,
+				Status: statusNames[exitUsage],
+				Error:  "same destination as " + first,
+				code:   exitUsage,
+			})
+			continue
+		}
+		claimed[dest] = line
+		items = append(items, item)
+		hubURLs = append(hubURLs, item.hubs...)
+	}
+	if err := s.Err(); err != nil {
+		fail(exitError, err)
+	}
+
+	var hubs []*adc.Hub
+	if len(hubURLs) > 0 {
+		hubs = connectHubs(identity(logger), hubURLs, logger)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fail(exitError, err)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	enc := json.NewEncoder(os.Stdout)
+	code := exitOK
+	for _, report := range skipped {
+		enc.Encode(report)
+		code = report.code
+	}
+	slots := make(chan bool, parallel)
+	for _, item := range items {
+		wg.Add(1)
+		slots <- true
+		go func(item *batchItem) {
+			defer func() { <-slots; wg.Done() }()
+			report := fetchItem(hubs, item, filepath.Join(dir, item.name), logger)
+			mu.Lock()
+			enc.Encode(report)
+			if code == exitOK {
+				code = report.code
+			}
+			mu.Unlock()
+		}(item)
+	}
+	wg.Wait()
+	os.Exit(code)
+}
+
+func parseBatchItem(line string) (*batchItem, error) {
+	item := &batchItem{raw: line}
+	u, err := url.Parse(line)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "magnet":
+		m, err := adc.ParseMagnet(line)
+		if err != nil {
+			return nil, err
+		}
+		if m.TTH == nil {
+			return nil, usageError("tiger tree hash not specified in magnet link")
+		}
+		item.tth = m.TTH
+		item.name = m.DisplayName
+		if item.name == "" {
+			item.name = m.TTH.String()
+		}
+		sources := append(m.ExactSources, m.AcceptableSources...)
+		for _, s := range append(sources, m.WebSources...) {
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			switch u.Scheme {
+			case "adc", "adcs":
+				item.hubs = append(item.hubs, u)
+			case "http", "https":
+				item.webSources = append(item.webSources, u)
+			}
+		}
+	case "adc", "adcs":
+		item.hubs = []*url.URL{u}
+		item.searchName = path.Base(u.Path)
+		item.name = item.searchName
+	case "http", "https":
+		item.webSources = []*url.URL{u}
+		item.name = outputName(u)
+	default:
+		return nil, usageError("Unsupported or unknown url scheme: " + u.Scheme)
+	}
+	item.name = filepath.Base(item.name)
+	return item, nil
+}
+
+// fetchItem downloads an item from the hubs, falling back to its
+// web sources, and reports how it went.
+func fetchItem(hubs []*adc.Hub, item *batchItem, dest string, logger *log.Logger) *batchReport {
+	report := &batchReport{URL: item.raw, Path: dest}
+	if item.tth != nil {
+		report.TTH = item.tth.String()
+	}
+
+	var err error = notFoundError("no sources for " + item.name)
+	if len(hubs) == 0 && len(item.hubs) > 0 {
+		err = networkError("Could not connect to any hub")
+	}
+	if len(hubs) > 0 && (item.tth != nil || len(item.hubs) > 0) {
+		var size uint64
+		size, report.Sources, err = fetchADC(hubs, item.searchName, item.tth, dest, false, logger)
+		report.Size = int64(size)
+	}
+	for _, u := range item.webSources {
+		if err == nil {
+			break
+		}
+		report.Size, err = httpFetch(u, dest, item.tth)
+		if err == nil {
+			report.Sources = []string{u.String()}
+		}
+	}
+
+	if err != nil {
+		report.code = exitCode(err)
+		report.Error = err.Error()
+	}
+	report.Status = statusNames[report.code]
+	return report
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/3M3RY/go-adc/adc"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Settings from the config file that have no flag of their own.
+var (
+	nick     string
+	password string
+	pins     = make(map[string]string) // host:port to keyprint
+)
+
+const configHelp = `The config file holds one setting per line, a key and a value
+separated by whitespace. Lines starting with '#' are ignored.
+Flags given on the command line override the file.
+	nick NICK               nick to use on hubs
+	password PASSWORD       password for hubs that ask for one
+	hub URL                 a hub to search, may be given more than once
+	pin HOST:PORT KEYPRINT  expected keyprint of an adcs:// hub, as SHA256/...
+	limit-rate RATE         as -limit-rate
+	peer-limit-rate RATE    as -peer-limit-rate
+	timeout DURATION        as -timeout
+`
+
+// loadConfig reads the config file at path, a missing file is
+// not an error unless the path was given with -config.
+func loadConfig(path string, explicit bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	s := bufio.NewScanner(file)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		key, args := fields[0], fields[1:]
+		if len(args) == 0 {
+			return fmt.Errorf("%s:%d: %s has no value", path, n, key)
+		}
+		switch key {
+		case "nick":
+			nick = args[0]
+		case "password":
+			password = args[0]
+		case "hub":
+			hubFlags = append(hubFlags, args[0])
+		case "pin":
+			if len(args) != 2 {
+				return fmt.Errorf("%s:%d: pin takes a host and a keyprint", path, n)
+			}
+			pins[args[0]] = args[1]
+		case "limit-rate", "peer-limit-rate", "timeout":
+			if set[key] {
+				continue
+			}
+			if err := flag.Set(key, args[0]); err != nil {
+				return fmt.Errorf("%s:%d: %s", path, n, err)
+			}
+		default:
+			return fmt.Errorf("%s:%d: unknown setting %s", path, n, key)
+		}
+	}
+	return s.Err()
+}
+
+// configureHub applies the nick, password and keyprint
+// from the config file to a hub URL that lacks them.
+func configureHub(u *url.URL) {
+	if u.User == nil && nick != "" {
+		if password != "" {
+			u.User = url.UserPassword(nick, password)
+		} else {
+			u.User = url.User(nick)
+		}
+	}
+	if kp, ok := pins[u.Host]; ok && u.Scheme == "adcs" {
+		q := u.Query()
+		if q.Get("kp") == "" {
+			q.Set("kp", kp)
+			u.RawQuery = q.Encode()
+		}
+	}
+}
+
+// identity returns the PID kept in the config directory,
+// or a throwaway one if it cannot be kept.
+func identity(logger *log.Logger) *adc.Identifier {
+	dir, err := adc.ConfigDir()
+	if err == nil {
+		var id *adc.Identity
+		id, err = adc.LoadOrCreateIdentity(filepath.Join(dir, "identity"))
+		if err == nil {
+			return id.PID
+		}
+	}
+	logger.Println("could not keep a client identity,", err)
+	id, err := adc.NewIdentity()
+	if err != nil {
+		fail(exitError, "could not generate a client identity,", err)
+	}
+	return id.PID
+}
+
+func defaultConfigPath() string {
+	dir, err := adc.ConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "adcget.conf")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/3M3RY/go-adc/adc"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+// how many times to retry a failed HTTP transfer,
+// waiting twice as long after each failure
+const (
+	httpRetries = 5
+	httpBackoff = time.Second
+)
+
+// httpStatusError is an HTTP response that was not a success.
+type httpStatusError struct {
+	status string
+	code   int
+}
+
+func (e *httpStatusError) Error() string { return e.status }
+
+// temporary reports whether the request may succeed if retried.
+func (e *httpStatusError) temporary() bool {
+	return e.code >= 500 || e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests
+}
+
+// verifyError is a download that did not match its hash.
+type verifyError string
+
+func (e verifyError) Error() string { return string(e) }
+
+func httpClient(u *url.URL) {
+	var tth *adc.TigerTreeHash
+	if searchTTH != "LWPNACQDBZRYXW3VHJVCJ64QBZNGHOHHHZWCLNQ" {
+		var err error
+		tth, err = adc.NewTigerTreeHash(searchTTH)
+		if err != nil {
+			fail(exitUsage, "Invalid TTH:", err)
+		}
+	}
+	if outputFilename == "" {
+		outputFilename = outputName(u)
+	}
+
+	n, err := httpFetch(u, outputFilename, tth)
+	if err != nil {
+		fail(exitCode(err), err)
+	}
+	done(n)
+}
+
+// outputName returns the file name to save u as when -output is not given.
+func outputName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "index.html"
+	}
+	return name
+}
+
+// httpFetch downloads u to name, resuming whatever part of name is
+// already present, or streams it to stdout if name is "-". If tth
+// is not nil the file is hashed as it is written and the download
+// fails if the hash does not match.
+func httpFetch(u *url.URL, name string, tth *adc.TigerTreeHash) (n int64, err error) {
+	try := func() (int64, error) { return httpAttempt(u, name, tth) }
+	if name == "-" {
+		s := stdoutStream()
+		try = func() (int64, error) { return s.attempt(u, tth) }
+	}
+
+	wait := httpBackoff
+	for attempt := 0; ; attempt++ {
+		n, err = try()
+		if err == nil {
+			return n, nil
+		}
+		if e, ok := err.(*httpStatusError); ok && !e.temporary() {
+			return n, err
+		}
+		if _, ok := err.(verifyError); ok || attempt == httpRetries {
+			return n, err
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s, retrying in %s\n", u.Host, err, wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func httpAttempt(u *url.URL, name string, tth *adc.TigerTreeHash) (int64, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// the part already on disk goes through the hasher first
+	hasher := adc.NewTreeHasher(1 << 30)
+	offset, err := io.Copy(hasher, file)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range, start over
+		if err = file.Truncate(0); err != nil {
+			return 0, err
+		}
+		if _, err = file.Seek(0, 0); err != nil {
+			return 0, err
+		}
+		hasher = adc.NewTreeHasher(1 << 30)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the file was already complete
+		if offset == 0 {
+			return 0, &httpStatusError{res.Status, res.StatusCode}
+		}
+		return offset, verify(name, hasher, tth)
+	default:
+		return 0, &httpStatusError{res.Status, res.StatusCode}
+	}
+
+	_, err = io.Copy(io.MultiWriter(file, hasher), res.Body)
+	if err != nil {
+		return 0, err
+	}
+	return hasher.Size(), verify(name, hasher, tth)
+}
+
+// httpStream is a download to stdout, where a retry
+// may only resume from what has been written so far.
+type httpStream struct {
+	w      io.Writer
+	hasher *adc.TreeHasher
+	offset int64
+}
+
+// stream is all that has gone to stdout. The peers write to it
+// too, so that if they fail part way through a fallback to HTTP
+// carries on from where they stopped rather than starting over.
+var stream *httpStream
+
+func stdoutStream() *httpStream {
+	if stream == nil {
+		stream = &httpStream{w: stdout, hasher: adc.NewTreeHasher(1 << 30)}
+	}
+	return stream
+}
+
+// Write passes p on to stdout and the hasher.
+func (s *httpStream) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.hasher.Write(p[:n])
+	s.offset += int64(n)
+	return n, err
+}
+
+func (s *httpStream) attempt(u *url.URL, tth *adc.TigerTreeHash) (int64, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return s.offset, err
+	}
+	if s.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", s.offset))
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return s.offset, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range, skip what was already sent
+		if _, err = io.CopyN(io.Discard, res.Body, s.offset); err != nil {
+			return s.offset, err
+		}
+	default:
+		return s.offset, &httpStatusError{res.Status, res.StatusCode}
+	}
+
+	_, err = io.Copy(s, res.Body)
+	if err != nil {
+		return s.offset, err
+	}
+	return s.offset, verify("-", s.hasher, tth)
+}
+
+// verify compares the hash of a completed file against tth,
+// removing the file if it does not match and is not stdout.
+func verify(name string, hasher *adc.TreeHasher, tth *adc.TigerTreeHash) error {
+	if tth == nil {
+		return nil
+	}
+	if !bytes.Equal(hasher.Root(), tth.Bytes()) {
+		if name != "-" {
+			os.Remove(name)
+		}
+		return verifyError(fmt.Sprintf("%s failed verification, expected TTH %s but got %s",
+			name, tth, adc.NewTigerTreeHashFromBytes(hasher.Root())))
+	}
+	return nil
+}
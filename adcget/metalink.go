@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"github.com/3M3RY/go-adc/adc"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// the hashes a metalink may give that can be checked
+var hashFuncs = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha-1":   sha1.New,
+	"sha-224": sha256.New224,
+	"sha-256": sha256.New,
+	"sha-384": sha512.New384,
+	"sha-512": sha512.New,
+}
+
+// isMetalink reports whether u names a Metalink file.
+func isMetalink(u *url.URL) bool {
+	switch u.Scheme {
+	case "", "file", "http", "https":
+	default:
+		return false
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	return ext == ".meta4" || ext == ".metalink"
+}
+
+func readMetalink(u *url.URL) (*adc.Metalink, error) {
+	var r io.Reader
+	switch u.Scheme {
+	case "http", "https":
+		res, err := http.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, &httpStatusError{res.Status, res.StatusCode}
+		}
+		r = res.Body
+	default:
+		file, err := os.Open(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+	return adc.ParseMetalink(r)
+}
+
+// metalinkClient downloads each file of a metalink from the hubs
+// and HTTP URLs it lists, as well as any hubs given, checking every
+// hash it provides. A single file is saved to -output, several
+// go beneath the -output directory.
+func metalinkClient(target *url.URL, hubURLs []*url.URL, logger *log.Logger) {
+	ml, err := readMetalink(target)
+	if err != nil {
+		fail(exitCode(err), "Error reading metalink,", err)
+	}
+	if outputFilename == "-" && len(ml.Files) > 1 {
+		fail(exitUsage, "Cannot stream a metalink of several files to stdout")
+	}
+
+	for _, f := range ml.Files {
+		for _, s := range f.URLs {
+			u, err := url.Parse(s)
+			if err == nil && (u.Scheme == "adc" || u.Scheme == "adcs") {
+				hubURLs = append(hubURLs, u)
+			}
+		}
+	}
+	var hubs []*adc.Hub
+	if len(hubURLs) > 0 {
+		hubs = connectHubs(identity(logger), hubURLs, logger)
+	}
+
+	code := exitOK
+	var total int64
+	for _, f := range ml.Files {
+		name, err := localName(f.Name)
+		if err == nil {
+			if len(ml.Files) == 1 && outputFilename != "" {
+				name = outputFilename
+			} else {
+				name = filepath.Join(outputFilename, name)
+			}
+			var n int64
+			n, err = fetchMetalinkFile(hubs, f, name, logger)
+			total += n
+		}
+		if err != nil {
+			logger.Println(err)
+			if code == exitOK {
+				code = exitCode(err)
+			}
+		}
+	}
+	if code != exitOK {
+		os.Exit(code)
+	}
+	done(total)
+}
+
+// localName turns the name of a metalink file into a relative
+// path that cannot climb out of the output directory.
+func localName(name string) (string, error) {
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if p == "" {
+		return "", usageError("bad file name in metalink: " + name)
+	}
+	return filepath.FromSlash(p), nil
+}
+
+// fetchMetalinkFile downloads f to name. When the size is known the
+// peers and web sources work on the file together, otherwise the web
+// sources are tried one after another if no peer has it.
+func fetchMetalinkFile(hubs []*adc.Hub, f *adc.MetalinkFile, name string, logger *log.Logger) (int64, error) {
+	if name != "-" {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return 0, err
+		}
+	}
+	check := newHashCheck(name, f, logger)
+	if name == "-" {
+		stdout = io.MultiWriter(os.Stdout, check)
+	}
+
+	var webSources []string
+	for _, s := range f.URLs {
+		u, err := url.Parse(s)
+		if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			webSources = append(webSources, s)
+		}
+	}
+
+	var err error = notFoundError("no sources for " + f.Name)
+	searchName := path.Base(f.Name)
+	if f.Size != 0 {
+		config := &adc.DownloadConfig{
+			OutputFilename: name,
+			Hash:           f.TTH,
+			Size:           f.Size,
+			WebSources:     webSources,
+		}
+		if f.TTH == nil {
+			config.SearchFilename = searchName
+		}
+		_, _, err = fetch(hubs, config, isTerminal(os.Stderr), logger)
+	} else {
+		if len(hubs) > 0 {
+			_, _, err = fetchADC(hubs, searchName, f.TTH, name, isTerminal(os.Stderr), logger)
+		}
+		for _, s := range webSources {
+			if err == nil {
+				break
+			}
+			u, _ := url.Parse(s)
+			logger.Println("falling back to", u)
+			_, err = httpFetch(u, name, f.TTH)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if name != "-" {
+		if err = check.file(); err != nil {
+			return 0, err
+		}
+	}
+	if err = check.verify(); err != nil {
+		if name != "-" {
+			os.Remove(name)
+		}
+		return 0, err
+	}
+	return check.size, nil
+}
+
+// hashCheck computes every hash a metalink gives for a file.
+type hashCheck struct {
+	name   string
+	f      *adc.MetalinkFile
+	tree   *adc.TreeHasher
+	hashes map[string]hash.Hash
+	pieces []*pieceCheck
+	w      io.Writer
+	size   int64
+}
+
+func newHashCheck(name string, f *adc.MetalinkFile, logger *log.Logger) *hashCheck {
+	c := &hashCheck{
+		name:   name,
+		f:      f,
+		hashes: make(map[string]hash.Hash),
+	}
+	var ws []io.Writer
+	if f.TTH != nil {
+		c.tree = adc.NewTreeHasher(1 << 30)
+		ws = append(ws, c.tree)
+	}
+	for typ := range f.Hashes {
+		if fn, ok := hashFuncs[typ]; ok {
+			h := fn()
+			c.hashes[typ] = h
+			ws = append(ws, h)
+		} else {
+			logger.Printf("cannot check the %s hash of %s", typ, f.Name)
+		}
+	}
+	for _, p := range f.Pieces {
+		if fn, ok := hashFuncs[p.Type]; ok {
+			pc := &pieceCheck{p: p, h: fn()}
+			c.pieces = append(c.pieces, pc)
+			ws = append(ws, pc)
+		} else {
+			logger.Printf("cannot check the %s piece hashes of %s", p.Type, f.Name)
+		}
+	}
+	c.w = io.MultiWriter(ws...)
+	return c
+}
+
+// Write never fails, so that the stream to stdout is not cut short.
+func (c *hashCheck) Write(b []byte) (int, error) {
+	c.w.Write(b)
+	c.size += int64(len(b))
+	return len(b), nil
+}
+
+// file hashes the downloaded file.
+func (c *hashCheck) file() error {
+	file, err := os.Open(c.name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(c, file)
+	return err
+}
+
+// verify compares what was hashed against the metalink.
+func (c *hashCheck) verify() error {
+	if c.f.Size != 0 && uint64(c.size) != c.f.Size {
+		return verifyError(fmt.Sprintf("%s is %d bytes rather than %d", c.name, c.size, c.f.Size))
+	}
+	if c.tree != nil && !bytes.Equal(c.tree.Root(), c.f.TTH.Bytes()) {
+		return verifyError(fmt.Sprintf("%s failed verification, expected TTH %s but got %s",
+			c.name, c.f.TTH, adc.NewTigerTreeHashFromBytes(c.tree.Root())))
+	}
+	types := make([]string, 0, len(c.hashes))
+	for typ := range c.hashes {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		if sum := c.hashes[typ].Sum(nil); !bytes.Equal(sum, c.f.Hashes[typ]) {
+			return verifyError(fmt.Sprintf("%s failed verification, expected %s %x but got %x",
+				c.name, typ, c.f.Hashes[typ], sum))
+		}
+	}
+	for _, pc := range c.pieces {
+		if err := pc.verify(); err != nil {
+			return verifyError(fmt.Sprintf("%s failed verification, %s", c.name, err))
+		}
+	}
+	return nil
+}
+
+// pieceCheck hashes each piece of a file in turn.
+type pieceCheck struct {
+	p   *adc.MetalinkPieces
+	h   hash.Hash
+	n   uint64 // bytes of the current piece hashed
+	i   int    // index of the current piece
+	err error
+}
+
+func (c *pieceCheck) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		m := c.p.Length - c.n
+		if m > uint64(len(b)) {
+			m = uint64(len(b))
+		}
+		c.h.Write(b[:m])
+		c.n += m
+		b = b[m:]
+		if c.n == c.p.Length {
+			c.next()
+		}
+	}
+	return n, nil
+}
+
+func (c *pieceCheck) next() {
+	if c.err == nil && (c.i >= len(c.p.Hashes) || !bytes.Equal(c.h.Sum(nil), c.p.Hashes[c.i])) {
+		c.err = fmt.Errorf("%s of piece %d does not match", c.p.Type, c.i)
+	}
+	c.i++
+	c.n = 0
+	c.h.Reset()
+}
+
+func (c *pieceCheck) verify() error {
+	if c.n > 0 {
+		c.next()
+	}
+	if c.err == nil && c.i != len(c.p.Hashes) {
+		c.err = fmt.Errorf("%d pieces rather than %d", c.i, len(c.p.Hashes))
+	}
+	return c.err
+}
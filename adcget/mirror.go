@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/3M3RY/go-adc/adc"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// how long to wait for a peer to send its file list
+const listTimeout = 2 * time.Minute
+
+// mirror downloads a directory from a peer's share, found either
+// by the -peer flag and the path of url, or by searching the hub
+// for a directory with the same name as the last element of url.
+func mirror(hub *adc.Hub, url *url.URL, logger *log.Logger) {
+	if url == nil {
+		fail(exitUsage, "a directory must be given as an adc:// URL")
+	}
+	if outputFilename == "-" {
+		fail(exitUsage, "a directory cannot be written to stdout")
+	}
+	dir := url.Path
+	var peer *adc.Peer
+	if peerName != "" {
+		peer = hub.FindPeer(peerName)
+		if peer == nil {
+			fail(exitNotFound, "no peer", peerName, "on the hub")
+		}
+	} else {
+		results := make(chan *adc.SearchResult, 32)
+		search := adc.NewSearch()
+		search.SetDirectory()
+		search.AddInclude(path.Base(dir))
+		search.SetResultChannel(results)
+		hub.Search(search)
+
+		stop := time.After(searchTimeout)
+		for peer == nil {
+			select {
+			case <-stop:
+				fail(exitNotFound, "failed to find directory", path.Base(dir))
+			case r := <-results:
+				if r.IsDirectory() {
+					peer = r.Peer()
+					dir = fmt.Sprintf("%s", adc.NewParameterValue(r.FullName))
+				}
+			}
+		}
+		// the hub blocks on results that are not taken, and
+		// would then not pass on the peer's connect-back
+		go func() {
+			for range results {
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), listTimeout)
+	list, err := peer.GetPartialFileList(ctx, dir, true)
+	cancel()
+	if err != nil {
+		fail(exitNetwork, fmt.Sprintf("could not get file list from %s: %s", peer.Nick, err))
+	}
+	root := list.Lookup(dir)
+	if root == nil {
+		root = &list.FileListDir
+	}
+
+	dest := outputFilename
+	if dest == "" {
+		dest = path.Base(dir)
+	}
+
+	var fetched, skipped, failed int
+	var bytes uint64
+	root.Walk(func(name string, f *adc.FileListFile) error {
+		var ok bool
+		err := checkListPath(name)
+		if err == nil {
+			ok, err = mirrorFile(hub, peer, filepath.Join(dest, filepath.FromSlash(name)), f, logger)
+		}
+		switch {
+		case err != nil:
+			logger.Printf("%s: %s", name, err)
+			failed++
+		case ok:
+			skipped++
+		default:
+			fetched++
+			bytes += f.Size
+		}
+		return nil
+	})
+
+	fmt.Fprintf(os.Stderr, "\n%d files (%d bytes) downloaded, %d already present, %d failed in %s\n",
+		fetched, bytes, skipped, failed, time.Since(start))
+	if failed > 0 {
+		os.Exit(exitError)
+	}
+	os.Exit(exitOK)
+}
+
+// checkListPath rejects a path built from the names in a peer's
+// file list that could climb out of the directory being mirrored.
+func checkListPath(name string) error {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" || elem == "." || elem == ".." || strings.Contains(elem, "\\") {
+			return fmt.Errorf("bad name in file list")
+		}
+	}
+	return nil
+}
+
+// mirrorFile downloads f from peer to name, and from any other
+// sources the hub turns up. A file already present with the right
+// hash is left alone and reported as ok.
+func mirrorFile(hub *adc.Hub, peer *adc.Peer, name string, f *adc.FileListFile, logger *log.Logger) (ok bool, err error) {
+	tth, err := adc.NewTigerTreeHash(f.TTH)
+	if err != nil {
+		return false, err
+	}
+	if info, err := os.Stat(name); err == nil && uint64(info.Size()) == f.Size {
+		if h, err := hashFile(name); err == nil && h == f.TTH {
+			return true, nil
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return false, err
+	}
+	if f.Size == 0 {
+		file, err := os.Create(name)
+		if err != nil {
+			return false, err
+		}
+		return false, file.Close()
+	}
+
+	config := &adc.DownloadConfig{
+		OutputFilename: name,
+		Hash:           tth,
+		Compress:       compress,
+	}
+	dispatcher, _ := adc.NewDownloadDispatcher(config, logger)
+	dispatcher.ResultChannel() <- adc.NewSearchResult(peer, "TTH/"+f.TTH, f.Size)
+
+	search := adc.NewSearch()
+	search.AddTTH(tth)
+	search.SetResultChannel(dispatcher.ResultChannel())
+	hub.Search(search)
+
+	dispatcher.Run(searchTimeout)
+	if <-dispatcher.FinalChannel() != f.Size {
+		return false, fmt.Errorf("download failed")
+	}
+	return false, nil
+}
+
+// hashFile returns the Tiger tree hash of a local file.
+func hashFile(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	t := adc.NewTreeHasher(1 << 30)
+	if _, err = io.Copy(t, file); err != nil {
+		return "", err
+	}
+	return adc.NewTigerTreeHashFromBytes(t.Root()).String(), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/3M3RY/go-adc/adc"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// sourceReport is printed for each search result with -json.
+type sourceReport struct {
+	Nick  string `json:"nick"`
+	CID   string `json:"cid"`
+	Path  string `json:"path"`
+	Size  uint64 `json:"size"`
+	TTH   string `json:"tth,omitempty"`
+	Slots int    `json:"slots"`
+}
+
+// searchClient searches the hubs for -search terms or the -tth hash,
+// printing every result that arrives before the timeout.
+func searchClient(hubURLs []*url.URL, logger *log.Logger) {
+	search := adc.NewSearch()
+	switch {
+	case listSources:
+		if searchTTH == "LWPNACQDBZRYXW3VHJVCJ64QBZNGHOHHHZWCLNQ" {
+			fail(exitUsage, "-list-sources needs a -tth to search for")
+		}
+		tth, err := adc.NewTigerTreeHash(searchTTH)
+		if err != nil {
+			fail(exitUsage, "Invalid TTH:", err)
+		}
+		search.AddTTH(tth)
+	default:
+		terms := strings.Fields(searchTerms)
+		if len(terms) == 0 {
+			fail(exitUsage, "No search terms given")
+		}
+		for _, term := range terms {
+			if strings.HasPrefix(term, "-") && len(term) > 1 {
+				search.AddExclude(term[1:])
+			} else {
+				search.AddInclude(term)
+			}
+		}
+	}
+	if len(hubURLs) == 0 {
+		fail(exitUsage, "No hub to search, give a hub URL or -hub")
+	}
+
+	hubs := connectHubs(identity(logger), hubURLs, logger)
+	if len(hubs) == 0 {
+		fail(exitNetwork, "Could not connect to any hub")
+	}
+
+	results := make(chan *adc.SearchResult, 32)
+	search.SetResultChannel(results)
+	for _, hub := range hubs {
+		hub.Search(search)
+	}
+
+	var reports []*sourceReport
+	timeout := time.After(searchTimeout)
+collect:
+	for {
+		select {
+		case r := <-results:
+			if r.Peer() == nil {
+				continue
+			}
+			report := &sourceReport{
+				Nick:  r.Peer().Nick,
+				CID:   r.Peer().CID,
+				Path:  fmt.Sprintf("%s", adc.NewParameterValue(r.FullName)),
+				Size:  r.Size(),
+				Slots: r.Slots(),
+			}
+			if r.TTH() != nil {
+				report.TTH = r.TTH().String()
+			}
+			reports = append(reports, report)
+		case <-timeout:
+			break collect
+		}
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		for _, report := range reports {
+			enc.Encode(report)
+		}
+	} else if len(reports) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NICK\tCID\tPATH\tSIZE\tTTH\tSLOTS")
+		for _, r := range reports {
+			slots := "?"
+			if r.Slots >= 0 {
+				slots = fmt.Sprint(r.Slots)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", r.Nick, r.CID, r.Path, r.Size, r.TTH, slots)
+		}
+		w.Flush()
+	}
+	if len(reports) == 0 {
+		fail(exitNotFound, "No results")
+	}
+	os.Exit(exitOK)
+}